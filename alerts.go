@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// cycleAlerts tracks consecutive failed update cycles so that the first
+// failure and the following recovery can be reported
+type cycleAlerts struct {
+	notifier Notifier
+	failures int
+}
+
+// observe records the outcome of an update cycle. It returns true when err is
+// nil and one or more cycles failed before it, resetting the failure count.
+func (a *cycleAlerts) observe(ctx context.Context, err error) bool {
+	if err != nil {
+		a.failures++
+		if a.failures == 1 {
+			if nerr := a.notifier.NotifyFailure(ctx, err); nerr != nil {
+				log.Warnf("Unable to send failure notification: %s\n", nerr)
+			}
+		}
+		return false
+	}
+	if a.failures == 0 {
+		return false
+	}
+	log.WithField("failed_cycles", a.failures).Infof("Update cycle recovered after %d failed cycles\n", a.failures)
+	if nerr := a.notifier.NotifyRecovery(ctx, a.failures); nerr != nil {
+		log.Warnf("Unable to send recovery notification: %s\n", nerr)
+	}
+	a.failures = 0
+	return true
+}
+
+// reached reports whether max consecutive cycles have failed. A max of 0
+// never does.
+func (a *cycleAlerts) reached(max int) bool {
+	return max > 0 && a.failures >= max
+}
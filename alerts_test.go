@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNotifier records the notifications it is sent
+type fakeNotifier struct {
+	failures   []error
+	recoveries []int
+}
+
+func (n *fakeNotifier) NotifyFailure(ctx context.Context, err error) error {
+	n.failures = append(n.failures, err)
+	return nil
+}
+
+func (n *fakeNotifier) NotifyRecovery(ctx context.Context, failedCycles int) error {
+	n.recoveries = append(n.recoveries, failedCycles)
+	return errors.New("notification failures are only logged")
+}
+
+func TestCycleAlerts_observe(t *testing.T) {
+	notifier := &fakeNotifier{}
+	a := &cycleAlerts{notifier: notifier}
+	ctx := context.Background()
+	assert.False(t, a.observe(ctx, nil))
+
+	assert.False(t, a.observe(ctx, errors.New("first")))
+	assert.False(t, a.observe(ctx, errors.New("second")))
+	assert.Equal(t, 2, a.failures)
+	assert.Equal(t, []error{errors.New("first")}, notifier.failures)
+
+	assert.True(t, a.observe(ctx, nil))
+	assert.Equal(t, 0, a.failures)
+	assert.False(t, a.observe(ctx, nil))
+	assert.Equal(t, []int{2}, notifier.recoveries)
+}
+
+func TestCycleAlerts_reached(t *testing.T) {
+	a := &cycleAlerts{notifier: noopNotifier{}}
+	a.observe(context.Background(), errors.New("boom"))
+	a.observe(context.Background(), errors.New("boom"))
+
+	assert.False(t, a.reached(0))
+	assert.False(t, a.reached(3))
+	assert.True(t, a.reached(2))
+
+	a.observe(context.Background(), nil)
+	assert.False(t, a.reached(2))
+}
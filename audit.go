@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// registryMatcher is implemented by writers that can report which of their
+// registries an ECR host would be written to, without writing anything
+type registryMatcher interface {
+	Matches(ctx context.Context, host string) ([]string, error)
+}
+
+// auditRecord describes what an update would do for one ECR host. It never
+// holds secrets.
+type auditRecord struct {
+	Host        string    `json:"host"`
+	RegistryIDs []string  `json:"registry_ids"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// auditReport holds the audit records of one update cycle
+type auditReport struct {
+	Time    time.Time     `json:"time"`
+	Records []auditRecord `json:"records"`
+}
+
+// lastAudit is the report of the most recent audit cycle, served on /status
+var lastAudit struct {
+	sync.Mutex
+	report *auditReport
+}
+
+// auditCredential records which registries the writers would write cred to
+func auditCredential(ctx context.Context, cred *ecrCredential, writers []CredentialWriter) auditRecord {
+	record := auditRecord{Host: cred.Host, RegistryIDs: []string{}, ExpiresAt: cred.ExpiresAt}
+	for _, writer := range writers {
+		matcher, ok := writer.(registryMatcher)
+		if !ok {
+			continue
+		}
+		ids, err := matcher.Matches(ctx, cred.Host)
+		if err != nil {
+			record.Error = err.Error()
+			continue
+		}
+		record.RegistryIDs = append(record.RegistryIDs, ids...)
+	}
+	log.WithFields(log.Fields{
+		"host":         record.Host,
+		"registry_ids": record.RegistryIDs,
+		"expires_at":   record.ExpiresAt,
+		"error":        record.Error,
+	}).Info("Audit record")
+	return record
+}
+
+// storeAudit makes records the report served on /status
+func storeAudit(records []auditRecord) {
+	lastAudit.Lock()
+	defer lastAudit.Unlock()
+	lastAudit.report = &auditReport{Time: time.Now(), Records: records}
+}
+
+// status serves the report of the most recent audit cycle as JSON
+func status(w http.ResponseWriter, r *http.Request) {
+	lastAudit.Lock()
+	report := lastAudit.report
+	lastAudit.Unlock()
+	if report == nil {
+		http.Error(w, "no audit cycle has completed", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Errorf("Unable to write status response: %s\n", err)
+	}
+}
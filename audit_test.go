@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+	"github.com/rancher/rancher-ecr-credentials/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAuditCredential(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{
+					Resource:      client.Resource{Id: "1r1"},
+					ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+				},
+				client.Registry{
+					Resource:      client.Resource{Id: "1r2"},
+					ServerAddress: "registry.example.com",
+				},
+			},
+		},
+		nil,
+	)
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+	failing := new(mocks.RegistryOperations)
+	failing.On("List", &client.ListOpts{}).Return(&client.RegistryCollection{}, errors.New("boom"))
+	expires := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+
+	record := auditCredential(context.Background(), &ecrCredential{
+		Host:      "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+		Password:  "mockPassword",
+		ExpiresAt: expires,
+	}, []CredentialWriter{
+		&RancherWriter{Registries: mockRegistry, Credentials: mockRegistryCredential},
+		&RancherWriter{Registries: failing, Credentials: mockRegistryCredential},
+		new(mocks.CredentialWriter),
+	})
+
+	assert.Equal(t, "012345678910.dkr.ecr.us-east-1.amazonaws.com", record.Host)
+	assert.Equal(t, []string{"1r1"}, record.RegistryIDs)
+	assert.Equal(t, expires, record.ExpiresAt)
+	assert.Contains(t, record.Error, "boom")
+	mockRegistryCredential.AssertNotCalled(t, "List", mock.Anything)
+	mockRegistryCredential.AssertNotCalled(t, "Update", mock.Anything, mock.Anything)
+}
+
+func TestAuditCredential_crossAccountName(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{
+					Resource:      client.Resource{Id: "1r1"},
+					Name:          "prod",
+					ServerAddress: "109876543210.dkr.ecr.us-east-1.amazonaws.com",
+				},
+				client.Registry{
+					Resource:      client.Resource{Id: "1r2"},
+					Name:          "proxy",
+					ServerAddress: "ecr-proxy.example.com",
+				},
+			},
+		},
+		nil,
+	)
+
+	record := auditCredential(context.Background(), &ecrCredential{
+		Host: "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+	}, []CredentialWriter{
+		&RancherWriter{
+			Registries:    mockRegistry,
+			MatchStrategy: "name",
+			Names: map[string]string{
+				"prod":  "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+				"proxy": "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+			},
+		},
+	})
+
+	// The registry in another account is not reported as matched
+	assert.Equal(t, []string{"1r2"}, record.RegistryIDs)
+}
+
+func TestStatus(t *testing.T) {
+	lastAudit.report = nil
+	rec := httptest.NewRecorder()
+	status(rec, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	storeAudit([]auditRecord{{Host: "012345678910.dkr.ecr.us-east-1.amazonaws.com", RegistryIDs: []string{"1r1"}}})
+	rec = httptest.NewRecorder()
+	status(rec, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"registry_ids":["1r1"]`)
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Config holds every setting of the updater, read from the environment by
+// LoadConfig. List settings are comma separated, as they are given in the
+// environment.
+type Config struct {
+	// Rancher API
+	URL                string
+	AccessKey          string
+	SecretKey          string
+	ProjectIDs         string
+	AllowedAccountIDs  string
+	AutoCreate         bool
+	StampManaged       bool
+	VerifyAfterUpdate  bool
+	FailOnClientInit   bool
+	ExitOnFirstFailure bool
+	// Rancher HTTP transport
+	RancherMaxIdleConns        int
+	RancherMaxIdleConnsPerHost int
+	RancherDialTimeout         time.Duration
+	RancherResponseTimeout     time.Duration
+	RancherListRetries         int
+	RancherUpdateRetries       int
+	// TLSMinVersion is the minimum TLS version of outbound connections, one
+	// of the keys of tlsVersions
+	TLSMinVersion string
+
+	// AWS
+	Region           string
+	RoleArn          string
+	ECREndpoint      string
+	STSRegion        string
+	STSEndpoint      string
+	UseFIPSEndpoints bool
+	MaxBackoff       time.Duration
+
+	// Registry selection
+	RegistryIDs           string
+	RegistryIDsFile       string
+	AllowedRegistryIDs    string
+	MatchStrategy         string
+	MatchIncludePath      bool
+	AllowAddressUpdate    bool
+	RegistryNameMap       string
+	VerifyRepositories    string
+	HostDenylist          string
+	AllowedRegions        string
+	SkipUnconfiguredHosts bool
+	FailOnNoMatch         bool
+	StrictTokens          bool
+	CheckTokenCount       bool
+	// DuplicateHostPolicy picks the token to use when several are returned
+	// for the same host, "first" or "latest_expiry"
+	DuplicateHostPolicy    string
+	ExpectedUsername       string
+	SkipUnexpectedUsername bool
+
+	// DryRun reports the changes that would be made without writing them,
+	// as log lines or, with DryRunOutput "json", JSON lines on stdout
+	DryRun       bool
+	DryRunOutput string
+	// AuditOnly records the registries each token would be written to, in the
+	// log and on /status, without writing anything
+	AuditOnly bool
+
+	// TokenOutputFile also writes the logins to this file when set
+	TokenOutputFile string
+
+	// Update loop
+	Interval         time.Duration
+	RefreshAtPercent int
+	CycleDeadline    time.Duration
+	// RegistryPollInterval lists the registries this often between cycles to
+	// write the cached tokens to new ones; 0 disables polling
+	RegistryPollInterval time.Duration
+	// HeartbeatInterval logs that the process is alive this often between
+	// cycles; 0 disables the heartbeat
+	HeartbeatInterval time.Duration
+	// FreezeWindows lists the weekly windows in which no credentials are
+	// written, see parseFreezeWindow
+	FreezeWindows string
+	// ShutdownGracePeriod bounds how long in-flight updates and HTTP requests
+	// may take to finish after a shutdown signal
+	ShutdownGracePeriod time.Duration
+	// MaxConsecutiveFailures exits the process after this many failed cycles
+	// in a row; 0 never exits
+	MaxConsecutiveFailures int
+	// RunOnce exits after a single update cycle
+	RunOnce bool
+
+	// HTTP listener
+	// ListenHost is the address to listen on, all addresses when empty
+	ListenHost       string
+	ListenPort       string
+	HTTPReadTimeout  time.Duration
+	HTTPWriteTimeout time.Duration
+	HTTPIdleTimeout  time.Duration
+	TLSCertFile      string
+	TLSKeyFile       string
+	RequireHTTP      bool
+	// DisableHealthcheck skips starting the listener, by default when RunOnce
+	// is set
+	DisableHealthcheck bool
+
+	// Notifications
+	NotifyWebhookURL string
+	NotifySlackURL   string
+
+	// Logging
+	LogLevel           string
+	LogTimeFormat      string
+	LogUTC             bool
+	DebugDumpResponses bool
+}
+
+// sensitiveFields lists the Config fields holding secrets, which are masked
+// whenever the configuration is printed
+var sensitiveFields = map[string]bool{
+	"AccessKey":        true,
+	"SecretKey":        true,
+	"NotifyWebhookURL": true,
+	"NotifySlackURL":   true,
+}
+
+// redactedValue replaces the value of a set sensitive field
+const redactedValue = "[redacted]"
+
+// redacted returns the settings by field name, with the values of the
+// sensitive fields masked, for printing
+func (cfg Config) redacted() map[string]interface{} {
+	fields := map[string]interface{}{}
+	v := reflect.ValueOf(cfg)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		value := v.Field(i).Interface()
+		if sensitiveFields[name] && value != "" {
+			value = redactedValue
+		}
+		fields[name] = value
+	}
+	return fields
+}
+
+// redactedJSON returns the redacted settings as a single JSON object, with
+// durations in their readable form (e.g. "6h0m0s")
+func (cfg Config) redactedJSON() ([]byte, error) {
+	fields := cfg.redacted()
+	for name, value := range fields {
+		if d, ok := value.(time.Duration); ok {
+			fields[name] = d.String()
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// LoadConfig reads and validates the configuration from the environment
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		URL:                 os.Getenv("CATTLE_URL"),
+		AccessKey:           os.Getenv("CATTLE_ACCESS_KEY"),
+		SecretKey:           os.Getenv("CATTLE_SECRET_KEY"),
+		ProjectIDs:          os.Getenv("CATTLE_PROJECT_IDS"),
+		AllowedAccountIDs:   os.Getenv("ALLOWED_ACCOUNT_IDS"),
+		Region:              os.Getenv("AWS_REGION"),
+		RoleArn:             os.Getenv("AWS_ROLE_ARN"),
+		ECREndpoint:         os.Getenv("AWS_ECR_ENDPOINT"),
+		STSRegion:           os.Getenv("AWS_STS_REGION"),
+		STSEndpoint:         os.Getenv("AWS_STS_ENDPOINT"),
+		RegistryIDs:         os.Getenv("AWS_ECR_REGISTRY_IDS"),
+		RegistryIDsFile:     os.Getenv("AWS_ECR_REGISTRY_IDS_FILE"),
+		AllowedRegistryIDs:  os.Getenv("ALLOWED_REGISTRY_IDS"),
+		VerifyRepositories:  os.Getenv("ECR_VERIFY_REPOSITORIES"),
+		HostDenylist:        os.Getenv("REGISTRY_HOST_DENYLIST"),
+		AllowedRegions:      os.Getenv("ALLOWED_ECR_REGIONS"),
+		FreezeWindows:       os.Getenv("FREEZE_WINDOWS"),
+		MatchStrategy:       "host",
+		DuplicateHostPolicy: "first",
+		ExpectedUsername:    "AWS",
+		DryRunOutput:        os.Getenv("DRY_RUN_OUTPUT"),
+		TokenOutputFile:     os.Getenv("TOKEN_OUTPUT_FILE"),
+		RegistryNameMap:     os.Getenv("REGISTRY_NAME_MAP"),
+		ListenPort:          "8080",
+		TLSMinVersion:       "1.2",
+		TLSCertFile:         os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:          os.Getenv("TLS_KEY_FILE"),
+		LogLevel:            os.Getenv("LOG_LEVEL"),
+		LogTimeFormat:       os.Getenv("LOG_TIME_FORMAT"),
+		NotifyWebhookURL:    os.Getenv("NOTIFY_WEBHOOK_URL"),
+		NotifySlackURL:      os.Getenv("NOTIFY_SLACK_WEBHOOK_URL"),
+	}
+	if v := os.Getenv("TLS_MIN_VERSION"); v != "" {
+		cfg.TLSMinVersion = v
+	}
+	if p, ok := os.LookupEnv("LISTEN_PORT"); ok {
+		cfg.ListenPort = p
+	}
+	if u, ok := os.LookupEnv("EXPECTED_ECR_USERNAME"); ok {
+		cfg.ExpectedUsername = u
+	}
+	// MATCH_BY is the former name of MATCH_STRATEGY
+	if m := os.Getenv("MATCH_BY"); m != "" {
+		cfg.MatchStrategy = m
+	}
+	if m := os.Getenv("MATCH_STRATEGY"); m != "" {
+		cfg.MatchStrategy = m
+	}
+	if p := os.Getenv("DUPLICATE_HOST_POLICY"); p != "" {
+		cfg.DuplicateHostPolicy = p
+	}
+
+	var err error
+	// BIND_ADDRESS takes precedence over LISTEN_PORT
+	if a := os.Getenv("BIND_ADDRESS"); a != "" {
+		if cfg.ListenHost, cfg.ListenPort, err = net.SplitHostPort(a); err != nil {
+			return cfg, fmt.Errorf("invalid BIND_ADDRESS: %s", err)
+		}
+		if cfg.ListenPort == "" {
+			return cfg, fmt.Errorf("invalid BIND_ADDRESS %q: missing port", a)
+		}
+	}
+	if cfg.RegistryIDs == "" && cfg.RegistryIDsFile != "" {
+		if cfg.RegistryIDs, err = readListFile(cfg.RegistryIDsFile); err != nil {
+			return cfg, fmt.Errorf("unable to read AWS_ECR_REGISTRY_IDS_FILE: %s", err)
+		}
+	}
+	if cfg.AutoCreate, err = envBool("AUTO_CREATE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.VerifyAfterUpdate, err = envBool("VERIFY_AFTER_UPDATE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.StampManaged, err = envBool("STAMP_MANAGED_LABEL", false); err != nil {
+		return cfg, err
+	}
+	if cfg.FailOnClientInit, err = envBool("FAIL_ON_CLIENT_INIT", true); err != nil {
+		return cfg, err
+	}
+	if cfg.ExitOnFirstFailure, err = envBool("EXIT_ON_FIRST_FAILURE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.UseFIPSEndpoints, err = envBool("USE_FIPS_ENDPOINTS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.AllowAddressUpdate, err = envBool("ALLOW_SERVER_ADDRESS_UPDATE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.MatchIncludePath, err = envBool("MATCH_INCLUDE_PATH", false); err != nil {
+		return cfg, err
+	}
+	if cfg.SkipUnconfiguredHosts, err = envBool("SKIP_UNCONFIGURED_HOSTS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.FailOnNoMatch, err = envBool("FAIL_ON_NO_MATCH", false); err != nil {
+		return cfg, err
+	}
+	if cfg.StrictTokens, err = envBool("STRICT_TOKENS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.CheckTokenCount, err = envBool("CHECK_TOKEN_COUNT", false); err != nil {
+		return cfg, err
+	}
+	if cfg.SkipUnexpectedUsername, err = envBool("SKIP_UNEXPECTED_USERNAME", false); err != nil {
+		return cfg, err
+	}
+	if cfg.DryRun, err = envBool("DRY_RUN", false); err != nil {
+		return cfg, err
+	}
+	if cfg.AuditOnly, err = envBool("AUDIT_ONLY", false); err != nil {
+		return cfg, err
+	}
+	if cfg.LogUTC, err = envBool("LOG_UTC", false); err != nil {
+		return cfg, err
+	}
+	if cfg.DebugDumpResponses, err = envBool("DEBUG_DUMP_RESPONSES", false); err != nil {
+		return cfg, err
+	}
+	if cfg.RancherMaxIdleConns, err = envInt("RANCHER_MAX_IDLE_CONNS", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.RancherMaxIdleConnsPerHost, err = envInt("RANCHER_MAX_IDLE_CONNS_PER_HOST", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.RancherListRetries, err = envInt("RANCHER_LIST_RETRIES", 2); err != nil {
+		return cfg, err
+	}
+	if cfg.RancherUpdateRetries, err = envInt("RANCHER_UPDATE_RETRIES", 1); err != nil {
+		return cfg, err
+	}
+	if cfg.RancherDialTimeout, err = envDuration("RANCHER_DIAL_TIMEOUT", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.RancherResponseTimeout, err = envDuration("RANCHER_RESPONSE_TIMEOUT", 60*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxBackoff, err = envDuration("MAX_BACKOFF", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.Interval, err = envDuration("REFRESH_INTERVAL", 6*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.CycleDeadline, err = envDuration("CYCLE_DEADLINE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.RegistryPollInterval, err = envDuration("REGISTRY_POLL_INTERVAL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.HeartbeatInterval, err = envDuration("HEARTBEAT_INTERVAL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.ShutdownGracePeriod, err = envDuration("SHUTDOWN_GRACE_PERIOD", 15*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.RefreshAtPercent, err = envInt("REFRESH_AT_PERCENT", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxConsecutiveFailures, err = envInt("MAX_CONSECUTIVE_FAILURES", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.RequireHTTP, err = envBool("REQUIRE_HTTP", false); err != nil {
+		return cfg, err
+	}
+	if cfg.RunOnce, err = envBool("RUN_ONCE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.DisableHealthcheck, err = envBool("DISABLE_HEALTHCHECK", cfg.RunOnce); err != nil {
+		return cfg, err
+	}
+	if cfg.HTTPReadTimeout, err = envDuration("HTTP_READ_TIMEOUT", 5*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.HTTPWriteTimeout, err = envDuration("HTTP_WRITE_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.HTTPIdleTimeout, err = envDuration("HTTP_IDLE_TIMEOUT", 60*time.Second); err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.validate()
+}
+
+// validate checks the settings that do not depend on the Rancher API
+func (cfg Config) validate() error {
+	if cfg.LogLevel != "" {
+		if _, err := log.ParseLevel(cfg.LogLevel); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL: %s", err)
+		}
+	}
+	if cfg.Interval <= 0 {
+		return fmt.Errorf("REFRESH_INTERVAL must be positive, got %s", cfg.Interval)
+	}
+	if cfg.RancherMaxIdleConns < 0 || cfg.RancherMaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("RANCHER_MAX_IDLE_CONNS and RANCHER_MAX_IDLE_CONNS_PER_HOST must not be negative")
+	}
+	if cfg.MaxConsecutiveFailures < 0 {
+		return fmt.Errorf("MAX_CONSECUTIVE_FAILURES must not be negative, got %d", cfg.MaxConsecutiveFailures)
+	}
+	if _, err := parseList(cfg.RegistryIDs); err != nil {
+		return fmt.Errorf("invalid AWS_ECR_REGISTRY_IDS: %s", err)
+	}
+	if cfg.RefreshAtPercent != 0 && (cfg.RefreshAtPercent < 1 || cfg.RefreshAtPercent > 99) {
+		return fmt.Errorf("REFRESH_AT_PERCENT must be between 1 and 99, got %d", cfg.RefreshAtPercent)
+	}
+	switch cfg.MatchStrategy {
+	case "host":
+		if cfg.AllowAddressUpdate && cfg.RegistryNameMap == "" {
+			return fmt.Errorf("REGISTRY_NAME_MAP must be set when ALLOW_SERVER_ADDRESS_UPDATE=true")
+		}
+	case "name":
+		if cfg.RegistryNameMap == "" {
+			return fmt.Errorf("REGISTRY_NAME_MAP must be set when MATCH_STRATEGY=name")
+		}
+		if cfg.AutoCreate {
+			return fmt.Errorf("AUTO_CREATE is not supported when MATCH_STRATEGY=name")
+		}
+		if cfg.AllowAddressUpdate {
+			return fmt.Errorf("ALLOW_SERVER_ADDRESS_UPDATE is only supported when MATCH_STRATEGY=host")
+		}
+	case "host_then_name":
+		if cfg.RegistryNameMap == "" {
+			return fmt.Errorf("REGISTRY_NAME_MAP must be set when MATCH_STRATEGY=host_then_name")
+		}
+		if cfg.AllowAddressUpdate {
+			return fmt.Errorf("ALLOW_SERVER_ADDRESS_UPDATE is only supported when MATCH_STRATEGY=host")
+		}
+	default:
+		return fmt.Errorf("MATCH_STRATEGY must be host, name or host_then_name, got %q", cfg.MatchStrategy)
+	}
+	if cfg.RancherListRetries < 0 || cfg.RancherUpdateRetries < 0 {
+		return fmt.Errorf("RANCHER_LIST_RETRIES and RANCHER_UPDATE_RETRIES must not be negative")
+	}
+	if _, err := parseFreezeWindows(cfg.FreezeWindows); err != nil {
+		return fmt.Errorf("invalid FREEZE_WINDOWS: %s", err)
+	}
+	if _, ok := tlsVersions[cfg.TLSMinVersion]; !ok {
+		return fmt.Errorf("TLS_MIN_VERSION must be 1.0, 1.1 or 1.2, got %q", cfg.TLSMinVersion)
+	}
+	if cfg.DuplicateHostPolicy != "first" && cfg.DuplicateHostPolicy != "latest_expiry" {
+		return fmt.Errorf("DUPLICATE_HOST_POLICY must be first or latest_expiry, got %q", cfg.DuplicateHostPolicy)
+	}
+	if cfg.AuditOnly && cfg.DryRun {
+		return fmt.Errorf("AUDIT_ONLY and DRY_RUN cannot both be enabled")
+	}
+	switch cfg.DryRunOutput {
+	case "", "log":
+	case "json":
+		if !cfg.DryRun {
+			return fmt.Errorf("DRY_RUN_OUTPUT requires DRY_RUN=true")
+		}
+	default:
+		return fmt.Errorf("DRY_RUN_OUTPUT must be log or json, got %q", cfg.DryRunOutput)
+	}
+	if cfg.UseFIPSEndpoints {
+		if err := validateFIPSRegion(cfg.Region); err != nil {
+			return err
+		}
+	}
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return fmt.Errorf("both TLS_CERT_FILE and TLS_KEY_FILE must be set to serve TLS")
+		}
+		for _, f := range []string{cfg.TLSCertFile, cfg.TLSKeyFile} {
+			if _, err := os.Stat(f); err != nil {
+				return fmt.Errorf("unable to read TLS file: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// envBool parses the boolean in the named environment variable, returning
+// def when it is unset or empty
+func envBool(name string, def bool) (bool, error) {
+	val, ok := os.LookupEnv(name)
+	if !ok || val == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return def, fmt.Errorf("unable to parse boolean value from %s: %s", name, err)
+	}
+	return b, nil
+}
+
+// envInt parses the integer in the named environment variable, returning def
+// when it is unset or empty
+func envInt(name string, def int) (int, error) {
+	val, ok := os.LookupEnv(name)
+	if !ok || val == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return def, fmt.Errorf("unable to parse integer value from %s: %s", name, err)
+	}
+	return i, nil
+}
+
+// envDuration parses the duration in the named environment variable, returning
+// def when it is unset or empty
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	val, ok := os.LookupEnv(name)
+	if !ok || val == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return def, fmt.Errorf("unable to parse duration value from %s: %s", name, err)
+	}
+	return d, nil
+}
+
+// splitMap splits a comma separated list of key=value pairs
+func splitMap(val string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, item := range splitList(val) {
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" || strings.TrimSpace(pair[1]) == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", item)
+		}
+		m[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+	}
+	return m, nil
+}
+
+// readListFile reads a file holding one entry per line, comma separated
+// entries or a JSON array, and returns them as a list setting
+func readListFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(b)), "[") {
+		return string(b), nil
+	}
+	return strings.Join(strings.Split(string(b), "\n"), ","), nil
+}
+
+// parseList parses a list setting given either as a JSON array of strings or
+// comma separated, dropping blank entries
+func parseList(val string) ([]string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(val), "[") {
+		return splitList(val), nil
+	}
+	items := []string{}
+	if err := json.Unmarshal([]byte(val), &items); err != nil {
+		return nil, fmt.Errorf("invalid JSON array: %s", err)
+	}
+	list := []string{}
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list, nil
+}
+
+// splitList splits a comma separated setting, dropping blank entries
+func splitList(val string) []string {
+	list := []string{}
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// splitHosts splits a comma (,) separated list of registry hosts, which may be
+// given as URLs, into lower cased hosts without scheme or path
+func splitHosts(val string) ([]string, error) {
+	hosts := []string{}
+	for _, item := range splitList(val) {
+		host, err := serverHost(item)
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("invalid registry host %q", item)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// listenAddress returns the address the HTTP listener binds to
+func (cfg Config) listenAddress() string {
+	return net.JoinHostPort(cfg.ListenHost, cfg.ListenPort)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setEnv sets the environment variables in vars, unsetting those with an
+// empty value, and returns a function that restores their previous values
+func setEnv(vars map[string]string) func() {
+	saved := map[string]*string{}
+	for name, val := range vars {
+		saved[name] = nil
+		if old, ok := os.LookupEnv(name); ok {
+			saved[name] = &old
+		}
+		if val == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, val)
+		}
+	}
+	return func() {
+		for name, old := range saved {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+func TestLoadConfig_defaults(t *testing.T) {
+	defer setEnv(map[string]string{
+		"CATTLE_URL":             "http://rancher.example.com",
+		"LISTEN_PORT":            "",
+		"REFRESH_INTERVAL":       "",
+		"MAX_BACKOFF":            "",
+		"FAIL_ON_CLIENT_INIT":    "",
+		"AUTO_CREATE":            "",
+		"EXPECTED_ECR_USERNAME":  "",
+		"RANCHER_LIST_RETRIES":   "",
+		"RANCHER_UPDATE_RETRIES": "",
+	})()
+
+	cfg, err := LoadConfig()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "http://rancher.example.com", cfg.URL)
+	assert.Equal(t, "8080", cfg.ListenPort)
+	assert.Equal(t, 6*time.Hour, cfg.Interval)
+	assert.Equal(t, 30*time.Second, cfg.MaxBackoff)
+	assert.True(t, cfg.FailOnClientInit)
+	assert.False(t, cfg.AutoCreate)
+	assert.Equal(t, "AWS", cfg.ExpectedUsername)
+	assert.Equal(t, 2, cfg.RancherListRetries)
+	assert.Equal(t, 1, cfg.RancherUpdateRetries)
+}
+
+func TestLoadConfig_invalid(t *testing.T) {
+	for name, val := range map[string]string{
+		"AUTO_CREATE":                 "maybe",
+		"REFRESH_INTERVAL":            "often",
+		"MAX_BACKOFF":                 "10",
+		"LOG_LEVEL":                   "chatty",
+		"USE_FIPS_ENDPOINTS":          "true",
+		"TLS_CERT_FILE":               "/nonexistent/cert.pem",
+		"MATCH_BY":                    "label",
+		"REFRESH_AT_PERCENT":          "100",
+		"DRY_RUN_OUTPUT":              "yaml",
+		"AWS_ECR_REGISTRY_IDS":        "[012345678910",
+		"ALLOW_SERVER_ADDRESS_UPDATE": "true",
+		"MATCH_STRATEGY":              "host_then_name",
+		"BIND_ADDRESS":                "8080",
+		"DUPLICATE_HOST_POLICY":       "random",
+		"TLS_MIN_VERSION":             "1.4",
+		"RANCHER_UPDATE_RETRIES":      "-1",
+		"FREEZE_WINDOWS":              "Sat",
+	} {
+		restore := setEnv(map[string]string{name: val})
+
+		_, err := LoadConfig()
+
+		assert.Error(t, err, name)
+		restore()
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	assert.Equal(t, []string{}, splitList(""))
+	assert.Equal(t, []string{"a", "b"}, splitList(" a, ,b,"))
+}
+
+func TestParseList(t *testing.T) {
+	for _, val := range []string{
+		"012345678910, 109876543210,",
+		`["012345678910", " 109876543210", ""]`,
+		` [ "012345678910","109876543210" ] `,
+	} {
+		list, err := parseList(val)
+		assert.NoError(t, err, val)
+		assert.Equal(t, []string{"012345678910", "109876543210"}, list, val)
+	}
+
+	_, err := parseList(`["012345678910", 109876543210]`)
+	assert.Error(t, err)
+}
+
+func TestLoadConfig_matchByNameRequiresMap(t *testing.T) {
+	defer setEnv(map[string]string{"MATCH_BY": "name", "MATCH_STRATEGY": "", "REGISTRY_NAME_MAP": ""})()
+
+	_, err := LoadConfig()
+	assert.Error(t, err)
+
+	os.Setenv("REGISTRY_NAME_MAP", "ecr-proxy=012345678910.dkr.ecr.us-east-1.amazonaws.com")
+	cfg, err := LoadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "name", cfg.MatchStrategy)
+}
+
+func TestSplitMap(t *testing.T) {
+	m, err := splitMap(" a=1.example.com, b = 2.example.com ")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1.example.com", "b": "2.example.com"}, m)
+
+	_, err = splitMap("a")
+	assert.Error(t, err)
+	_, err = splitMap("=b")
+	assert.Error(t, err)
+}
+
+func TestLoadConfig_registryIDsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "registry-ids")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("012345678910\n 109876543210 ,555555555555\r\n\n")
+	f.Close()
+
+	defer setEnv(map[string]string{"AWS_ECR_REGISTRY_IDS_FILE": f.Name(), "AWS_ECR_REGISTRY_IDS": ""})()
+	cfg, err := LoadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"012345678910", "109876543210", "555555555555"}, splitList(cfg.RegistryIDs))
+
+	os.Setenv("AWS_ECR_REGISTRY_IDS", "999999999999")
+	cfg, err = LoadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"999999999999"}, splitList(cfg.RegistryIDs))
+
+	os.Unsetenv("AWS_ECR_REGISTRY_IDS")
+	os.Setenv("AWS_ECR_REGISTRY_IDS_FILE", "/nonexistent/registry-ids")
+	_, err = LoadConfig()
+	assert.Error(t, err)
+}
+
+func TestConfig_redacted(t *testing.T) {
+	cfg := Config{
+		URL:              "http://rancher.example.com",
+		AccessKey:        "access-key-value",
+		SecretKey:        "secret-key-value",
+		NotifyWebhookURL: "https://hooks.example.com/token-value",
+		NotifySlackURL:   "https://hooks.slack.com/services/T0/B0/slack-value",
+		Interval:         time.Hour,
+	}
+
+	fields := cfg.redacted()
+	rendered := fmt.Sprint(fields)
+
+	for _, secret := range []string{"access-key-value", "secret-key-value", "token-value", "slack-value"} {
+		assert.NotContains(t, rendered, secret)
+	}
+	assert.Equal(t, redactedValue, fields["SecretKey"])
+	assert.Equal(t, "http://rancher.example.com", fields["URL"])
+	assert.Equal(t, time.Hour, fields["Interval"])
+	assert.Equal(t, "", Config{}.redacted()["SecretKey"])
+
+	data, err := cfg.redactedJSON()
+	assert.NoError(t, err)
+	for _, secret := range []string{"access-key-value", "secret-key-value", "token-value", "slack-value"} {
+		assert.NotContains(t, string(data), secret)
+	}
+	var decoded map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "1h0m0s", decoded["Interval"])
+	assert.Equal(t, redactedValue, decoded["AccessKey"])
+}
+
+func TestLoadConfig_bindAddress(t *testing.T) {
+	defer setEnv(map[string]string{"LISTEN_PORT": "9090", "BIND_ADDRESS": "127.0.0.1:8081"})()
+
+	cfg, err := LoadConfig()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", cfg.ListenHost)
+	assert.Equal(t, "8081", cfg.ListenPort)
+	assert.Equal(t, "127.0.0.1:8081", cfg.listenAddress())
+
+	os.Setenv("BIND_ADDRESS", "")
+	cfg, err = LoadConfig()
+
+	assert.NoError(t, err)
+	assert.Equal(t, ":9090", cfg.listenAddress())
+}
+
+func TestLoadConfig_runOnceDisablesHealthcheck(t *testing.T) {
+	defer setEnv(map[string]string{"RUN_ONCE": "", "DISABLE_HEALTHCHECK": ""})()
+	cfg, err := LoadConfig()
+	assert.NoError(t, err)
+	assert.False(t, cfg.DisableHealthcheck)
+
+	os.Setenv("RUN_ONCE", "true")
+	cfg, err = LoadConfig()
+	assert.NoError(t, err)
+	assert.True(t, cfg.RunOnce)
+	assert.True(t, cfg.DisableHealthcheck)
+
+	os.Setenv("DISABLE_HEALTHCHECK", "false")
+	cfg, err = LoadConfig()
+	assert.NoError(t, err)
+	assert.False(t, cfg.DisableHealthcheck)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/client"
+)
+
+// maskedPassword stands in for the password in dry run diffs
+const maskedPassword = "********"
+
+// credentialDiff describes the change a dry run would have made to the
+// registries of an ECR host
+type credentialDiff struct {
+	Host          string `json:"host"`
+	RegistryID    string `json:"registry_id,omitempty"`
+	ServerAddress string `json:"server_address,omitempty"`
+	// Action is "update", "create" or "skip"
+	Action          string `json:"action"`
+	Reason          string `json:"reason,omitempty"`
+	CurrentUsername string `json:"current_username,omitempty"`
+	DesiredUsername string `json:"desired_username,omitempty"`
+	DesiredPassword string `json:"desired_password,omitempty"`
+}
+
+// dryRun reports what Write would change for host without writing anything
+func (w *RancherWriter) dryRun(ctx context.Context, host, username string, registries []client.Registry) error {
+	for _, registry := range registries {
+		if registryHost, err := serverHost(registry.ServerAddress); err != nil || registryHost == "" {
+			w.reportDiff(credentialDiff{
+				Host:          host,
+				RegistryID:    registry.Id,
+				ServerAddress: registry.ServerAddress,
+				Action:        "skip",
+				Reason:        "invalid server address",
+			})
+		}
+	}
+
+	matches, foreign := w.match(registries, host)
+	for _, registry := range foreign {
+		w.reportDiff(credentialDiff{
+			Host:          host,
+			RegistryID:    registry.Id,
+			ServerAddress: registry.ServerAddress,
+			Action:        "skip",
+			Reason:        "registry in another AWS account",
+		})
+	}
+	if len(matches) == 0 && len(foreign) > 0 {
+		return nil
+	}
+	if target := w.driftedRegistry(registries, host); len(matches) == 0 && target != nil {
+		w.reportDiff(credentialDiff{
+			Host:            host,
+			RegistryID:      target.Id,
+			ServerAddress:   target.ServerAddress,
+			Action:          "update",
+			Reason:          "server address would be changed to " + host,
+			DesiredUsername: username,
+			DesiredPassword: maskedPassword,
+		})
+		return nil
+	}
+	if len(matches) == 0 {
+		diff := credentialDiff{Host: host, Action: "skip", Reason: "no matching registry"}
+		if w.AutoCreate {
+			diff = credentialDiff{
+				Host:            host,
+				ServerAddress:   host,
+				Action:          "create",
+				DesiredUsername: username,
+				DesiredPassword: maskedPassword,
+			}
+		}
+		w.reportDiff(diff)
+		return nil
+	}
+
+	for _, registry := range matches {
+		diff := credentialDiff{
+			Host:          host,
+			RegistryID:    registry.Id,
+			ServerAddress: registry.ServerAddress,
+		}
+		credentials, err := w.listCredentials(ctx, registry.Id)
+		switch {
+		case err != nil:
+			diff.Action = "skip"
+			diff.Reason = "failed to retrieve registry credentials: " + err.Error()
+		case len(credentials) != 1:
+			diff.Action = "skip"
+			diff.Reason = "registry does not have exactly 1 credential"
+		default:
+			diff.Action = "update"
+			diff.CurrentUsername = credentials[0].PublicValue
+			diff.DesiredUsername = username
+			diff.DesiredPassword = maskedPassword
+		}
+		w.reportDiff(diff)
+	}
+	return nil
+}
+
+// reportDiff logs diff and, when DiffOutput is set, writes it there as a line
+// of JSON
+func (w *RancherWriter) reportDiff(diff credentialDiff) {
+	registryLog(diff.Host, diff.RegistryID).WithFields(log.Fields{
+		"action": diff.Action,
+		"reason": diff.Reason,
+	}).Info("Dry run: not writing credential")
+	if w.DiffOutput == nil {
+		return
+	}
+	if err := json.NewEncoder(w.DiffOutput).Encode(diff); err != nil {
+		log.Errorf("Unable to write dry run diff: %s\n", err)
+	}
+}
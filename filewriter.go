@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileWriter stores the logins of all ECR hosts in a file in the "auths"
+// format of the Docker config.json, for other tools to consume. Entries for
+// other hosts and other settings already in the file are preserved.
+type FileWriter struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// dockerAuth is the login for one registry host in a Docker config.json
+type dockerAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Auth is the base64 encoded username:password
+	Auth string `json:"auth"`
+}
+
+// Write sets the login for host in the file, replacing any earlier login
+// for it. The file is replaced atomically and only readable by its owner.
+func (w *FileWriter) Write(ctx context.Context, host, username, password string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	config, auths, err := readDockerConfig(w.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read token output file: %s", err)
+	}
+	if auths[host], err = json.Marshal(dockerAuth{
+		Username: username,
+		Password: password,
+		Auth:     base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+	}); err != nil {
+		return err
+	}
+	if config["auths"], err = json.Marshal(auths); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(w.Path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write token output file: %s", err)
+	}
+	registryLog(host, "").Infof("Successfully wrote credential to %s", w.Path)
+	return nil
+}
+
+// readDockerConfig returns the top level settings of the Docker config.json
+// at path and its "auths" entries, both empty if the file does not exist
+func readDockerConfig(path string) (map[string]json.RawMessage, map[string]json.RawMessage, error) {
+	config := map[string]json.RawMessage{}
+	auths := map[string]json.RawMessage{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, auths, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, nil, err
+	}
+	if raw, ok := config["auths"]; ok {
+		if err := json.Unmarshal(raw, &auths); err != nil {
+			return nil, nil, fmt.Errorf("invalid auths: %s", err)
+		}
+	}
+	return config, auths, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// over path, so readers never see a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token-output")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auths.json")
+
+	w := &FileWriter{Path: path}
+	assert.NoError(t, w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "AWS", "first"))
+	assert.NoError(t, w.Write(context.Background(), "109876543210.dkr.ecr.us-east-1.amazonaws.com", "AWS", "second"))
+	assert.NoError(t, w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "AWS", "third"))
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	var file struct {
+		Auths map[string]dockerAuth `json:"auths"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &file))
+	assert.Equal(t, map[string]dockerAuth{
+		"012345678910.dkr.ecr.us-east-1.amazonaws.com": {Username: "AWS", Password: "third", Auth: "QVdTOnRoaXJk"},
+		"109876543210.dkr.ecr.us-east-1.amazonaws.com": {Username: "AWS", Password: "second", Auth: "QVdTOnNlY29uZA=="},
+	}, file.Auths)
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1, "temporary files are cleaned up")
+}
+
+func TestFileWriter_preservesEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token-output")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{
+  "auths": {
+    "registry.example.com": {"auth": "c3RhdGljOnNlY3JldA=="},
+    "012345678910.dkr.ecr.us-east-1.amazonaws.com": {"auth": "QVdTOm9sZA=="}
+  },
+  "credHelpers": {"gcr.io": "gcloud"}
+}`), 0600))
+
+	w := &FileWriter{Path: path}
+	assert.NoError(t, w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "AWS", "new"))
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	var file struct {
+		Auths       map[string]map[string]string `json:"auths"`
+		CredHelpers map[string]string            `json:"credHelpers"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &file))
+	assert.Equal(t, map[string]map[string]string{
+		"registry.example.com":                         {"auth": "c3RhdGljOnNlY3JldA=="},
+		"012345678910.dkr.ecr.us-east-1.amazonaws.com": {"username": "AWS", "password": "new", "auth": "QVdTOm5ldw=="},
+	}, file.Auths)
+	assert.Equal(t, map[string]string{"gcr.io": "gcloud"}, file.CredHelpers)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("not json"), 0600))
+	assert.Error(t, w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "AWS", "new"))
+}
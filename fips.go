@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// fipsEndpoint holds the FIPS 140-2 validated endpoints of a region
+type fipsEndpoint struct {
+	ECR string
+	STS string
+}
+
+// The vendored SDK has no FIPS endpoint resolution, so the regions offering
+// FIPS endpoints for both ECR and STS are listed here.
+var fipsEndpoints = map[string]fipsEndpoint{
+	"us-east-1":     {"https://ecr-fips.us-east-1.amazonaws.com", "https://sts-fips.us-east-1.amazonaws.com"},
+	"us-east-2":     {"https://ecr-fips.us-east-2.amazonaws.com", "https://sts-fips.us-east-2.amazonaws.com"},
+	"us-west-1":     {"https://ecr-fips.us-west-1.amazonaws.com", "https://sts-fips.us-west-1.amazonaws.com"},
+	"us-west-2":     {"https://ecr-fips.us-west-2.amazonaws.com", "https://sts-fips.us-west-2.amazonaws.com"},
+	"us-gov-east-1": {"https://ecr-fips.us-gov-east-1.amazonaws.com", "https://sts.us-gov-east-1.amazonaws.com"},
+	"us-gov-west-1": {"https://ecr-fips.us-gov-west-1.amazonaws.com", "https://sts.us-gov-west-1.amazonaws.com"},
+}
+
+// validateFIPSRegion returns an error if region has no FIPS endpoints
+func validateFIPSRegion(region string) error {
+	if _, ok := fipsEndpoints[region]; !ok {
+		return fmt.Errorf("FIPS endpoints are not available in AWS region %q", region)
+	}
+	return nil
+}
+
+// ecrConfig returns the ECR client configuration for the selected endpoints
+func ecrConfig(cfg Config) *aws.Config {
+	ecrCfg := aws.NewConfig()
+	if cfg.UseFIPSEndpoints {
+		ecrCfg = ecrCfg.WithEndpoint(fipsEndpoints[cfg.Region].ECR)
+	}
+	return ecrCfg
+}
+
+// stsConfig returns the STS client configuration for the selected endpoints.
+// AWS_STS_REGION and AWS_STS_ENDPOINT take precedence over the ECR region and
+// the FIPS endpoint.
+func stsConfig(cfg Config) *aws.Config {
+	stsCfg := aws.NewConfig()
+	if cfg.UseFIPSEndpoints {
+		stsCfg = stsCfg.WithEndpoint(fipsEndpoints[cfg.Region].STS)
+	}
+	if cfg.STSRegion != "" {
+		stsCfg = stsCfg.WithRegion(cfg.STSRegion)
+	}
+	if cfg.STSEndpoint != "" {
+		stsCfg = stsCfg.WithEndpoint(cfg.STSEndpoint)
+	}
+	return stsCfg
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStsConfig(t *testing.T) {
+	assert.Nil(t, stsConfig(Config{Region: "us-east-1"}).Endpoint)
+
+	fips := stsConfig(Config{Region: "us-east-1", UseFIPSEndpoints: true})
+	assert.Equal(t, "https://sts-fips.us-east-1.amazonaws.com", aws.StringValue(fips.Endpoint))
+
+	custom := stsConfig(Config{
+		Region:           "us-east-1",
+		UseFIPSEndpoints: true,
+		STSRegion:        "us-west-2",
+		STSEndpoint:      "https://sts.us-west-2.amazonaws.com",
+	})
+	assert.Equal(t, "us-west-2", aws.StringValue(custom.Region))
+	assert.Equal(t, "https://sts.us-west-2.amazonaws.com", aws.StringValue(custom.Endpoint))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// weekdays maps the day names accepted in FREEZE_WINDOWS to weekdays
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// freezeWindow is a weekly time range in UTC during which no credentials are
+// written, e.g. "Sat-Sun 00:00-24:00" or "* 22:00-02:00"
+type freezeWindow struct {
+	text string
+	// days are the weekdays the window starts on
+	days [7]bool
+	// start and end are minutes since midnight. A window whose end is not
+	// after its start runs past midnight into the next day.
+	start, end int
+}
+
+func (w freezeWindow) String() string {
+	return w.text
+}
+
+// contains reports whether t falls into the window
+func (w freezeWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	yesterday := (day + 6) % 7
+	return (w.days[day] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// until returns when the occurrence of the window that t falls into ends
+func (w freezeWindow) until(t time.Time) time.Time {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if w.start >= w.end && w.days[t.Weekday()] && t.Hour()*60+t.Minute() >= w.start {
+		midnight = midnight.AddDate(0, 0, 1)
+	}
+	return midnight.Add(time.Duration(w.end) * time.Minute)
+}
+
+// activeFreeze returns the first of windows that t falls into
+func activeFreeze(windows []freezeWindow, t time.Time) (freezeWindow, bool) {
+	for _, w := range windows {
+		if w.contains(t) {
+			return w, true
+		}
+	}
+	return freezeWindow{}, false
+}
+
+// parseFreezeWindows parses a comma (,) separated list of freeze windows
+func parseFreezeWindows(val string) ([]freezeWindow, error) {
+	windows := []freezeWindow{}
+	for _, text := range splitList(val) {
+		w, err := parseFreezeWindow(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid freeze window %q: %s", text, err)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// parseFreezeWindow parses "<days> <HH:MM>-<HH:MM>", where days is "*", a day
+// name such as "Sat" or a range of day names such as "Fri-Mon"
+func parseFreezeWindow(text string) (freezeWindow, error) {
+	w := freezeWindow{text: text}
+	fields := strings.Fields(text)
+	if len(fields) != 2 {
+		return w, fmt.Errorf("expected <days> <HH:MM>-<HH:MM>")
+	}
+
+	if fields[0] == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	} else {
+		days := strings.SplitN(strings.ToLower(fields[0]), "-", 2)
+		first, ok := weekdays[days[0]]
+		if !ok {
+			return w, fmt.Errorf("unknown day %q", days[0])
+		}
+		last := first
+		if len(days) == 2 {
+			if last, ok = weekdays[days[1]]; !ok {
+				return w, fmt.Errorf("unknown day %q", days[1])
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return w, fmt.Errorf("expected a time range <HH:MM>-<HH:MM>")
+	}
+	var err error
+	if w.start, err = parseClock(times[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(times[1]); err != nil {
+		return w, err
+	}
+	if w.start == 24*60 {
+		return w, fmt.Errorf("start time must be before 24:00")
+	}
+	return w, nil
+}
+
+// parseClock returns the minutes since midnight of a HH:MM time, allowing
+// 24:00 for the end of the day
+func parseClock(text string) (int, error) {
+	parts := strings.SplitN(text, ":", 2)
+	if len(parts) != 2 || len(parts[0]) != 2 || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", text)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", text)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", text)
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q", text)
+	}
+	return hour*60 + minute, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/rancher/rancher-ecr-credentials/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFreezeWindow_contains(t *testing.T) {
+	// 2017-03-04 is a Saturday
+	saturday := func(hour, minute int) time.Time {
+		return time.Date(2017, 3, 4, hour, minute, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		window string
+		at     time.Time
+		frozen bool
+	}{
+		{"Sat-Sun 00:00-24:00", saturday(0, 0), true},
+		{"Sat-Sun 00:00-24:00", saturday(23, 59), true},
+		{"Sat-Sun 00:00-24:00", saturday(0, 0).Add(-time.Minute), false},
+		{"Fri-Mon 00:00-24:00", saturday(12, 0), true},
+		{"Mon 09:00-17:00", saturday(12, 0), false},
+		{"* 09:00-17:00", saturday(12, 0), true},
+		{"* 09:00-17:00", saturday(17, 0), false},
+		// windows past midnight end on the following day
+		{"Fri 22:00-02:00", saturday(1, 59), true},
+		{"Fri 22:00-02:00", saturday(2, 0), false},
+		{"Fri 22:00-02:00", saturday(23, 0), false},
+		{"sat 22:00-02:00", saturday(23, 0), true},
+		// times are in UTC
+		{"Sat 12:00-13:00", saturday(12, 30).In(time.FixedZone("UTC-5", -5*60*60)), true},
+	} {
+		windows, err := parseFreezeWindows(test.window)
+		assert.NoError(t, err, test.window)
+
+		_, frozen := activeFreeze(windows, test.at)
+
+		assert.Equal(t, test.frozen, frozen, "%s at %s", test.window, test.at)
+	}
+}
+
+func TestFreezeWindow_until(t *testing.T) {
+	saturday := func(hour, minute int) time.Time {
+		return time.Date(2017, 3, 4, hour, minute, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		window string
+		at     time.Time
+		until  time.Time
+	}{
+		{"* 09:00-17:00", saturday(12, 0), saturday(17, 0)},
+		{"Sat 00:00-24:00", saturday(12, 0), saturday(24, 0)},
+		{"Fri 22:00-02:00", saturday(1, 0), saturday(2, 0)},
+		{"sat 22:00-02:00", saturday(23, 0), saturday(26, 0)},
+	} {
+		windows, err := parseFreezeWindows(test.window)
+		assert.NoError(t, err, test.window)
+
+		assert.Equal(t, test.until, windows[0].until(test.at), "%s at %s", test.window, test.at)
+	}
+}
+
+func TestParseFreezeWindows_invalid(t *testing.T) {
+	for _, val := range []string{
+		"Sat",
+		"Someday 00:00-01:00",
+		"Sat-Someday 00:00-01:00",
+		"Sat 00:00",
+		"Sat 0:00-01:00",
+		"Sat 25:00-01:00",
+		"Sat 00:60-01:00",
+		"Sat 24:00-01:00",
+		"Sat 00:00-24:01",
+	} {
+		_, err := parseFreezeWindows(val)
+
+		assert.Error(t, err, val)
+	}
+
+	windows, err := parseFreezeWindows("")
+	assert.NoError(t, err)
+	assert.Empty(t, windows)
+}
+
+func TestMain_freezeWindow(t *testing.T) {
+	windows, err := parseFreezeWindows("* 00:00-24:00")
+	assert.NoError(t, err)
+	r := &Rancher{FreezeWindows: windows}
+	mockEcr := new(mocks.ECRAPI)
+	mockWriter := new(mocks.CredentialWriter)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+			},
+		}, nil)
+
+	res := r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+
+	mockEcr.AssertExpectations(t)
+	mockWriter.AssertNotCalled(t, "Write", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.NoError(t, res.Err)
+	assert.True(t, res.Frozen)
+	assert.True(t, res.FreezeUntil.After(time.Now()))
+	assert.Equal(t, 1, res.Skipped)
+}
+
+func TestMain_freezeWindowStrictTokens(t *testing.T) {
+	windows, err := parseFreezeWindows("* 00:00-24:00")
+	assert.NoError(t, err)
+	r := &Rancher{FreezeWindows: windows, StrictTokens: true, ExpectedUsername: "AWS"}
+	mockEcr := new(mocks.ECRAPI)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+			},
+		}, nil)
+
+	res := r.updateEcr(context.Background(), mockEcr, []CredentialWriter{new(mocks.CredentialWriter)})
+
+	// Token checks still fail the cycle during a freeze
+	assert.True(t, res.Frozen)
+	assert.Error(t, res.Err)
+}
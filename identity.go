@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The vendored SDK predates the STS GetCallerIdentity operation, so the
+// request is built directly on the STS client using these shapes.
+
+type getCallerIdentityInput struct {
+	_ struct{} `type:"structure"`
+}
+
+type getCallerIdentityOutput struct {
+	_ struct{} `type:"structure"`
+
+	Account *string `type:"string"`
+	Arn     *string `min:"20" type:"string"`
+	UserId  *string `type:"string"`
+}
+
+// logCallerIdentity logs the AWS account and principal used for ECR calls.
+// Failures are only logged, since STS may not be reachable from every network.
+func logCallerIdentity(cfg Config, sess *session.Session) {
+	svc := sts.New(sess, stsConfig(cfg))
+	out := &getCallerIdentityOutput{}
+	req := svc.NewRequest(&request.Operation{
+		Name:       "GetCallerIdentity",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}, &getCallerIdentityInput{}, out)
+	if err := req.Send(); err != nil {
+		log.Warnf("Unable to determine AWS caller identity: %s\n", err)
+		return
+	}
+	log.Printf("Using AWS identity %s in account %s\n", aws.StringValue(out.Arn), aws.StringValue(out.Account))
+}
@@ -1,17 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
@@ -26,209 +36,988 @@ type Rancher struct {
 	SecretKey   string
 	RegistryIds []string
 	AutoCreate  bool
-	client      *client.RancherClient
+	// ProjectIDs restricts updates to registries in these projects (environments)
+	ProjectIDs []string
+	// MatchStrategy selects how registries are matched to ECR hosts, see matchRegistry
+	MatchStrategy string
+	// RegistryNames maps Rancher registry names to ECR hosts when matching by name
+	RegistryNames map[string]string
+	// VerifyRepositories lists repositories that must be accessible in every registry
+	VerifyRepositories []string
+	// HostDenylist lists registry hosts whose credentials are never updated,
+	// lower cased and without scheme or path
+	HostDenylist []string
+	// AllowedRegions restricts updates to ECR hosts in these regions; empty
+	// allows all regions
+	AllowedRegions []string
+	// FreezeWindows are the windows in which tokens are retrieved but not
+	// written
+	FreezeWindows []freezeWindow
+	// SkipUnconfiguredHosts only processes tokens for hosts a writer already knows about
+	SkipUnconfiguredHosts bool
+	// FailOnNoMatch fails the cycle when a token matches no registry
+	FailOnNoMatch bool
+	// StrictTokens fails the cycle when any authorization token cannot be decoded
+	StrictTokens bool
+	// CheckTokenCount warns when AWS returns a different number of
+	// authorization tokens than registry IDs were requested
+	CheckTokenCount bool
+	// DuplicateHostPolicy picks the token to use when several are returned
+	// for the same host, see keepDuplicate
+	DuplicateHostPolicy string
+	// ExpectedUsername is the username every decoded token should carry; empty
+	// disables the check
+	ExpectedUsername string
+	// SkipUnexpectedUsername skips tokens whose username is not ExpectedUsername
+	// instead of only warning about them
+	SkipUnexpectedUsername bool
+	// AuditOnly records which registries each token would be written to
+	// instead of writing it
+	AuditOnly bool
+	// DryRun is set when the writers only report the changes they would make
+	DryRun bool
+	// pending holds the hosts deferred by the previous cycle's deadline
+	pending map[string]bool
+	// cached holds the credentials decoded by the previous cycle
+	cached []*ecrCredential
+	// cycles counts the update cycles started
+	cycles int
+	client *client.RancherClient
 }
 
-func initLogger() {
+func initLogger(cfg Config) {
 	// check if config param has been set for log level, otherwise the default of the logrus package will be used
-	if logLevel, ok := os.LookupEnv("LOG_LEVEL"); ok && logLevel != "" {
-		logLevelObj, err := log.ParseLevel(logLevel)
+	if cfg.LogLevel != "" {
+		logLevelObj, err := log.ParseLevel(cfg.LogLevel)
 		if err != nil {
 			log.Error(err)
+		} else {
+			log.SetLevel(logLevelObj)
 		}
-		log.SetLevel(logLevelObj)
 	}
 	// set log format to JSON
-	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	var formatter log.Formatter = &log.TextFormatter{FullTimestamp: true, TimestampFormat: cfg.LogTimeFormat}
+	if cfg.LogUTC {
+		formatter = utcFormatter{formatter}
+	}
+	log.SetFormatter(formatter)
+}
+
+// utcFormatter formats log entries with their timestamp in UTC
+type utcFormatter struct {
+	log.Formatter
+}
+
+func (f utcFormatter) Format(entry *log.Entry) ([]byte, error) {
+	entry.Time = entry.Time.UTC()
+	return f.Formatter.Format(entry)
 }
 
 func main() {
-	initLogger()
-	log.Info("Starting ECR Credential Updater")
-	r := Rancher{
-		URL:         os.Getenv("CATTLE_URL"),
-		AccessKey:   os.Getenv("CATTLE_ACCESS_KEY"),
-		SecretKey:   os.Getenv("CATTLE_SECRET_KEY"),
-		RegistryIds: []string{},
-	}
-	if val, ok := os.LookupEnv("AUTO_CREATE"); ok {
-		b, err := strconv.ParseBool(val)
-		if err != nil {
-			log.Fatalf("Unable to parse boolean value from AUTO_CREATE: %s\n", err)
+	healthcheckMode := flag.Bool("healthcheck", false, "probe the healthcheck endpoint of a running instance and exit")
+	validateMode := flag.Bool("validate", false, "validate the configuration and access to Rancher and AWS and exit")
+	flag.Parse()
+
+	cfg, err := LoadConfig()
+	initLogger(cfg)
+	if err == nil {
+		// The vendored Rancher client builds its HTTP clients internally, so the
+		// tuned transport can only be applied as the default transport, which
+		// the AWS SDK uses as well
+		http.DefaultTransport = rancherTransport(cfg)
+		log.Infof("Requiring TLS %s or later for outbound connections\n", cfg.TLSMinVersion)
+	}
+	if *validateMode {
+		if !printChecks(os.Stdout, validateSetup(cfg, err)) {
+			os.Exit(1)
 		}
-		r.AutoCreate = b
+		os.Exit(0)
 	}
-	rancher, err := client.NewRancherClient(&client.ClientOpts{
-		Url:       r.URL,
-		AccessKey: r.AccessKey,
-		SecretKey: r.SecretKey,
-	})
 	if err != nil {
-		log.Fatalf("Unable to create Rancher API client: %s\n", err)
+		log.Fatalf("Invalid configuration: %s\n", err)
+	}
+
+	if *healthcheckMode {
+		if err := probe(cfg); err != nil {
+			log.Errorf("Healthcheck failed: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	log.Info("Starting ECR Credential Updater")
+	if data, err := cfg.redactedJSON(); err != nil {
+		log.Warnf("Unable to encode the effective configuration: %s\n", err)
+	} else {
+		log.Infof("Effective configuration: %s\n", data)
+	}
+	maxBackoff = cfg.MaxBackoff
+	rancherListAttempts = cfg.RancherListRetries + 1
+	rancherUpdateAttempts = cfg.RancherUpdateRetries + 1
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stop := newShutdown(cfg.ShutdownGracePeriod, signals)
+
+	r, err := NewRancher(stop.ctx, cfg)
+	if err != nil {
+		if stop.ctx.Err() != nil {
+			log.Info("Shut down before a Rancher API client could be created")
+			return
+		}
+		log.Fatalf("Unable to configure ECR Credential Updater: %s\n", err)
 	}
-	r.client = rancher
 	log.Debug("Created Rancher API Client")
 
-	if ids, ok := os.LookupEnv("AWS_ECR_REGISTRY_IDS"); ok && ids != "" {
-		log.Debug("Detected AWS_ECR_REGISTRY_IDS config param")
-		r.RegistryIds = strings.Split(ids, ",")
+	if err := checkRancherAccess(r.client.Registry); err != nil {
+		if cfg.ExitOnFirstFailure {
+			log.Fatalf("Rancher self-check failed: %s\n", err)
+		}
+		log.Errorf("Rancher self-check failed: %s\n", err)
+	} else {
+		log.Info("Rancher self-check succeeded: able to list registries")
+	}
+
+	if allowed := splitList(cfg.AllowedAccountIDs); len(allowed) > 0 {
+		if err := checkRegistryAccounts(r.client.Registry, allowed); err != nil {
+			log.Fatalf("Rancher API key scope check failed: %s\n", err)
+		}
+		log.Info("Rancher API key only sees registries in allowed accounts")
+	}
+
+	server := newHealthcheckServer(cfg)
+	if cfg.DisableHealthcheck {
+		log.Info("Healthcheck listener disabled")
+	} else {
+		go healthcheck(cfg, server)
 	}
 
-	go healthcheck()
+	logCallerIdentity(cfg, awsSession(cfg))
 
-	r.updateEcr(awsClient(), r.client.Registry, r.client.RegistryCredential)
-	ticker := time.NewTicker(6 * time.Hour)
+	if err := checkECRAccess(awsClient(cfg), r.RegistryIds); err != nil {
+		if cfg.ExitOnFirstFailure {
+			log.Fatalf("ECR self-check failed: %s\n", err)
+		}
+		log.Errorf("ECR self-check failed: %s\n", err)
+	} else {
+		log.Info("ECR self-check succeeded: able to get authorization tokens")
+	}
+
+	rancherWriter := &RancherWriter{
+		Registries:         r.client.Registry,
+		Credentials:        r.client.RegistryCredential,
+		AutoCreate:         r.AutoCreate,
+		ProjectIDs:         r.ProjectIDs,
+		MatchStrategy:      r.MatchStrategy,
+		IncludePath:        cfg.MatchIncludePath,
+		AllowAddressUpdate: cfg.AllowAddressUpdate,
+		StampManaged:       cfg.StampManaged,
+		VerifyAfterUpdate:  cfg.VerifyAfterUpdate,
+		Names:              r.RegistryNames,
+		DumpResponses:      cfg.DebugDumpResponses,
+		DryRun:             cfg.DryRun,
+	}
+	if cfg.AuditOnly {
+		log.Warn("Audit only mode enabled: no credentials will be written")
+	}
+	if cfg.DryRun {
+		log.Warn("Dry run enabled: no credentials will be written")
+		if cfg.DryRunOutput == "json" {
+			rancherWriter.DiffOutput = os.Stdout
+		}
+	}
+	writers := []CredentialWriter{rancherWriter}
+	if cfg.TokenOutputFile != "" {
+		if cfg.DryRun {
+			log.Warnf("Dry run enabled: not writing tokens to %s\n", cfg.TokenOutputFile)
+		} else {
+			writers = append(writers, &FileWriter{Path: cfg.TokenOutputFile})
+		}
+	}
+
+	var poller *registryPoller
+	var polls <-chan time.Time
+	if cfg.RegistryPollInterval > 0 && !cfg.AuditOnly {
+		poller = &registryPoller{writer: rancherWriter}
+		ticker := time.NewTicker(cfg.RegistryPollInterval)
+		defer ticker.Stop()
+		polls = ticker.C
+	}
+
+	var heartbeats <-chan time.Time
+	if cfg.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(cfg.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeats = ticker.C
+	}
+
+	alerts := &cycleAlerts{notifier: newNotifier(cfg)}
 	for {
-		log.Debug("Sleeping until next poll cycle")
-		<-ticker.C
-		r.updateEcr(awsClient(), r.client.Registry, r.client.RegistryCredential)
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if cfg.CycleDeadline > 0 {
+			ctx, cancel = context.WithTimeout(stop.ctx, cfg.CycleDeadline)
+		} else {
+			ctx, cancel = context.WithCancel(stop.ctx)
+		}
+		res := r.updateEcr(ctx, awsClient(cfg), writers)
+		cancel()
+		if res.Err != nil {
+			log.Errorf("Update cycle failed: %s\n", res.Err)
+		}
+		alerts.observe(context.Background(), res.Err)
+		state.recordCycle(res, time.Now())
+		if cfg.RunOnce {
+			if res.Err != nil {
+				log.Fatal("Exiting after a failed update cycle")
+			}
+			log.Info("Exiting after a single update cycle")
+			return
+		}
+		if alerts.reached(cfg.MaxConsecutiveFailures) {
+			log.Fatalf("Exiting after %d consecutive failed update cycles\n", alerts.failures)
+		}
+		wait := cfg.Interval
+		if cfg.RefreshAtPercent > 0 && !res.ExpiresAt.IsZero() {
+			wait = nextRefresh(res.ExpiresAt, cfg.RefreshAtPercent, time.Now())
+		}
+		log.Debugf("Sleeping %s until next poll cycle", wait)
+		if poller != nil {
+			poller.baseline(stop.ctx)
+		}
+		refreshAt := time.Now().Add(wait)
+		state.schedule(refreshAt, cfg.Interval)
+		next := time.After(wait)
+	waiting:
+		for {
+			select {
+			case <-next:
+				break waiting
+			case now := <-polls:
+				if _, frozen := activeFreeze(r.FreezeWindows, now); !frozen {
+					poller.poll(stop.ctx, r.cached, now)
+				}
+			case <-heartbeats:
+				state.logHeartbeat(refreshAt)
+			case <-stop.requested:
+				stop.finish(server)
+				return
+			}
+		}
+	}
+}
+
+// NewRancher validates cfg and returns a Rancher updater with a connected
+// Rancher API client. Retrying the client creation stops when ctx is done.
+func NewRancher(ctx context.Context, cfg Config) (*Rancher, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("missing Rancher URL")
+	}
+	if _, err := url.Parse(cfg.URL); err != nil {
+		return nil, fmt.Errorf("invalid Rancher URL: %s", err)
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("missing Rancher access key or secret key")
+	}
+	registryNames, err := splitMap(cfg.RegistryNameMap)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry name map: %s", err)
+	}
+	registryIDs, err := parseList(cfg.RegistryIDs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry IDs: %s", err)
+	}
+	hostDenylist, err := splitHosts(cfg.HostDenylist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry host denylist: %s", err)
+	}
+	freezeWindows, err := parseFreezeWindows(cfg.FreezeWindows)
+	if err != nil {
+		return nil, fmt.Errorf("invalid freeze windows: %s", err)
+	}
+	if registryIDs, err = allowRegistryIDs(registryIDs, splitList(cfg.AllowedRegistryIDs)); err != nil {
+		return nil, err
 	}
+
+	r := &Rancher{
+		URL:                    cfg.URL,
+		AccessKey:              cfg.AccessKey,
+		SecretKey:              cfg.SecretKey,
+		RegistryIds:            registryIDs,
+		AutoCreate:             cfg.AutoCreate,
+		ProjectIDs:             splitList(cfg.ProjectIDs),
+		MatchStrategy:          cfg.MatchStrategy,
+		RegistryNames:          registryNames,
+		VerifyRepositories:     splitList(cfg.VerifyRepositories),
+		HostDenylist:           hostDenylist,
+		AllowedRegions:         splitList(cfg.AllowedRegions),
+		FreezeWindows:          freezeWindows,
+		SkipUnconfiguredHosts:  cfg.SkipUnconfiguredHosts,
+		FailOnNoMatch:          cfg.FailOnNoMatch,
+		StrictTokens:           cfg.StrictTokens,
+		CheckTokenCount:        cfg.CheckTokenCount,
+		DuplicateHostPolicy:    cfg.DuplicateHostPolicy,
+		AuditOnly:              cfg.AuditOnly,
+		DryRun:                 cfg.DryRun,
+		ExpectedUsername:       cfg.ExpectedUsername,
+		SkipUnexpectedUsername: cfg.SkipUnexpectedUsername,
+	}
+	rancher, err := r.newClient(ctx, cfg.FailOnClientInit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Rancher API client: %s", err)
+	}
+	r.client = rancher
+	return r, nil
 }
 
-func (r *Rancher) updateEcr(
-	svc ecriface.ECRAPI,
-	registryClient client.RegistryOperations,
-	registryCredentialClient client.RegistryCredentialOperations) {
+// allowRegistryIDs drops the registry IDs not in allowed, logging each one.
+// An empty allowlist allows every registry ID.
+func allowRegistryIDs(registryIDs, allowed []string) ([]string, error) {
+	if len(allowed) == 0 {
+		return registryIDs, nil
+	}
+	if len(registryIDs) == 0 {
+		return nil, errors.New("AWS_ECR_REGISTRY_IDS must be set when ALLOWED_REGISTRY_IDS is set")
+	}
+	accounts := map[string]bool{}
+	for _, id := range allowed {
+		accounts[id] = true
+	}
+	kept := []string{}
+	for _, id := range registryIDs {
+		if !accounts[id] {
+			log.Warnf("Skipping registry ID %s, it is not in ALLOWED_REGISTRY_IDS\n", id)
+			continue
+		}
+		kept = append(kept, id)
+	}
+	if len(kept) == 0 {
+		return nil, errors.New("none of the registry IDs are in ALLOWED_REGISTRY_IDS")
+	}
+	return kept, nil
+}
 
-	log.Println("Updating ECR Credentials")
+// checkRancherAccess lists the registries once, describing the likely cause
+// when the Rancher credentials cannot be used to do so
+func checkRancherAccess(registries client.RegistryOperations) error {
+	_, err := registries.List(&client.ListOpts{})
+	if err == nil {
+		return nil
+	}
+	switch e := err.(type) {
+	case *client.ApiError:
+		switch e.StatusCode {
+		case http.StatusUnauthorized:
+			return fmt.Errorf("authentication failed, check CATTLE_ACCESS_KEY and CATTLE_SECRET_KEY: %s", e.Status)
+		case http.StatusForbidden:
+			return fmt.Errorf("API key is not permitted to list registries, check its environment and role: %s", e.Status)
+		case http.StatusNotFound:
+			return fmt.Errorf("registries API not found, check CATTLE_URL points at a Rancher API endpoint: %s", e.Status)
+		}
+		return fmt.Errorf("unexpected Rancher API response: %s", e.Status)
+	case *url.Error:
+		return fmt.Errorf("unable to reach Rancher, check CATTLE_URL and network access: %s", e)
+	}
+	return err
+}
+
+// checkECRAccess requests an authorization token for the configured registries
+// once, describing the likely cause when it cannot be retrieved
+func checkECRAccess(svc ecriface.ECRAPI, registryIDs []string) error {
+	request := &ecr.GetAuthorizationTokenInput{}
+	if len(registryIDs) > 0 {
+		request.RegistryIds = aws.StringSlice(registryIDs)
+	}
+	_, err := svc.GetAuthorizationToken(request)
+	if err == nil {
+		return nil
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		if isAccessDenied(reqErr) {
+			return fmt.Errorf("AWS credentials are not permitted to get ECR authorization tokens, check the IAM policy allows ecr:GetAuthorizationToken: %s", reqErr.Message())
+		}
+		return fmt.Errorf("unexpected AWS response (%s): %s", reqErr.Code(), reqErr.Message())
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "NoCredentialProviders":
+			return fmt.Errorf("no AWS credentials found: %s", awsErr.Message())
+		case "RequestError":
+			return fmt.Errorf("unable to reach ECR, check AWS_REGION and network access: %s", awsErr.Message())
+		}
+	}
+	return err
+}
+
+// isAccessDenied reports whether err is an AWS authorization failure
+func isAccessDenied(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+	if !ok {
+		return false
+	}
+	switch {
+	case reqErr.StatusCode() == http.StatusUnauthorized, reqErr.StatusCode() == http.StatusForbidden:
+		return true
+	case reqErr.Code() == "AccessDeniedException", reqErr.Code() == "UnrecognizedClientException":
+		return true
+	}
+	return false
+}
+
+// checkRegistryAccounts returns an error if any registry visible to the API
+// key belongs to a Rancher account (environment) outside allowed, which
+// indicates an over-scoped key such as an admin key
+func checkRegistryAccounts(registries client.RegistryOperations, allowed []string) error {
+	collection, err := registries.List(&client.ListOpts{})
+	if err != nil {
+		return fmt.Errorf("failed to retrieve registries: %s", err)
+	}
+	accounts := map[string]bool{}
+	for _, id := range allowed {
+		accounts[id] = true
+	}
+	outside := map[string]bool{}
+	for _, registry := range collection.Data {
+		if !accounts[registry.AccountId] {
+			outside[registry.AccountId] = true
+		}
+	}
+	if len(outside) > 0 {
+		ids := []string{}
+		for id := range outside {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return fmt.Errorf("API key can see registries in accounts outside ALLOWED_ACCOUNT_IDS: %s", strings.Join(ids, ","))
+	}
+	return nil
+}
+
+// newClient creates the Rancher API client. When failFast is false, creation
+// is retried with exponential backoff until it succeeds or ctx is done.
+func (r *Rancher) newClient(ctx context.Context, failFast bool) (*client.RancherClient, error) {
+	attempts := 1
+	if !failFast {
+		attempts = math.MaxInt32
+	}
+	var rancher *client.RancherClient
+	err := retry(ctx, attempts, retryBaseDelay, func() error {
+		var err error
+		rancher, err = client.NewRancherClient(&client.ClientOpts{
+			Url:       r.URL,
+			AccessKey: r.AccessKey,
+			SecretKey: r.SecretKey,
+		})
+		if err != nil && !failFast {
+			log.Printf("Unable to create Rancher API client, retrying: %s\n", err)
+		}
+		return err
+	})
+	return rancher, err
+}
+
+// cycleResult summarizes one update cycle
+type cycleResult struct {
+	// ExpiresAt is the earliest token expiry, or the zero time when no token was retrieved
+	ExpiresAt      time.Time
+	Updated        int
+	Failed         int
+	Skipped        int
+	Unmatched      []string
+	DecodeFailures int
+	// TokenCountMismatch is set when CheckTokenCount is on and AWS returned a
+	// different number of tokens than expected
+	TokenCountMismatch bool
+	// Frozen is set when the cycle fell into a freeze window and wrote nothing
+	Frozen bool
+	// FreezeUntil is when the freeze window the cycle fell into ends
+	FreezeUntil time.Time
+	// DryRun is set when the writers only reported their changes, which are
+	// counted in WouldUpdate instead of Updated
+	DryRun      bool
+	WouldUpdate int
+	// ParseFailures counts tokens that decoded but were not in <user>:<password> format
+	ParseFailures int
+	// UsernameMismatches counts tokens whose username was not the expected one
+	UsernameMismatches int
+	// FailedRegistryIDs lists the registry IDs no token could be retrieved for
+	// when they were requested individually
+	FailedRegistryIDs []string
+	// Remaining counts the registries left unprocessed when the cycle deadline passed
+	Remaining int
+	// Err is set when the cycle counts as failed
+	Err error
+}
+
+// updateEcr fetches ECR tokens and hands them to the writers
+func (r *Rancher) updateEcr(ctx context.Context, svc ecriface.ECRAPI, writers []CredentialWriter) cycleResult {
+	res := cycleResult{Unmatched: []string{}, DryRun: r.DryRun}
+
+	r.cycles++
+	regions := "all"
+	if len(r.AllowedRegions) > 0 {
+		regions = strings.Join(r.AllowedRegions, ",")
+	}
+	registryIDs := "default"
+	if len(r.RegistryIds) > 0 {
+		registryIDs = strconv.Itoa(len(r.RegistryIds))
+	}
+	log.WithFields(log.Fields{
+		"cycle":        r.cycles,
+		"registry_ids": registryIDs,
+		"regions":      regions,
+		"rancher_url":  r.URL,
+		"writers":      len(writers),
+		"dry_run":      r.DryRun,
+		"audit_only":   r.AuditOnly,
+	}).Info("Updating ECR Credentials")
 
 	request := &ecr.GetAuthorizationTokenInput{}
 	if len(r.RegistryIds) > 0 {
 		request = &ecr.GetAuthorizationTokenInput{RegistryIds: aws.StringSlice(r.RegistryIds)}
 	}
-	resp, err := svc.GetAuthorizationToken(request)
-	log.Debug(resp)
+	var resp *ecr.GetAuthorizationTokenOutput
+	err := retry(ctx, retryAttempts, retryBaseDelay, func() error {
+		var err error
+		resp, err = svc.GetAuthorizationToken(request)
+		return err
+	})
+	if err != nil && len(r.RegistryIds) > 1 && isRegistryIDError(err) {
+		logAWSError("GetAuthorizationToken", err)
+		log.Warnf("Requesting tokens for the %d registry IDs individually\n", len(r.RegistryIds))
+		resp, res.FailedRegistryIDs, err = getTokensPerRegistry(ctx, svc, r.RegistryIds)
+	}
 	if err != nil {
-		log.Printf("Error calling AWS API: %s\n", err)
-		return
+		logAWSError("GetAuthorizationToken", err)
+		res.Err = fmt.Errorf("error calling AWS API: %s", err)
+		return res
 	}
 	log.Println("Returned from AWS GetAuthorizationToken call successfully")
 
 	if len(resp.AuthorizationData) < 1 {
 		log.Println("Request did not return authorization data")
-		return
+		res.Err = errors.New("request did not return authorization data")
+		return res
 	}
 
+	if r.CheckTokenCount {
+		expected := len(r.RegistryIds)
+		if expected == 0 {
+			expected = 1
+		}
+		if got := len(resp.AuthorizationData); got != expected {
+			log.Warnf("Expected %d authorization tokens, AWS returned %d\n", expected, got)
+			res.TokenCountMismatch = true
+		}
+	}
+
+	// Decode every token once up front so each output works from the same credentials
+	credentials := []*ecrCredential{}
+	hosts := map[string]int{}
 	for _, data := range resp.AuthorizationData {
-		r.processToken(data, registryClient, registryCredentialClient)
+		cred, err := decodeToken(data)
+		if err != nil {
+			host := ""
+			if data != nil {
+				host, _ = serverHost(aws.StringValue(data.ProxyEndpoint))
+			}
+			registryLog(host, "").Warnf("Skipping authorization data: %s", err)
+			if err == errTokenFormat {
+				res.ParseFailures++
+			} else {
+				res.DecodeFailures++
+			}
+			continue
+		}
+		if len(r.RegistryIds) == 0 {
+			registryLog(cred.Host, "").Infof("Using the default registry of account %s", cred.RegistryID)
+		}
+		if r.ExpectedUsername != "" && cred.Username != r.ExpectedUsername {
+			res.UsernameMismatches++
+			if r.SkipUnexpectedUsername {
+				registryLog(cred.Host, "").Warnf("Skipping token with unexpected username %q, expected %q", cred.Username, r.ExpectedUsername)
+				continue
+			}
+			registryLog(cred.Host, "").Warnf("Token has unexpected username %q, expected %q", cred.Username, r.ExpectedUsername)
+		}
+		if i, ok := hosts[cred.Host]; ok {
+			if r.keepDuplicate(credentials[i], cred) {
+				registryLog(cred.Host, "").Warnf("Received several tokens for the host, using the one expiring at %s", cred.ExpiresAt)
+				credentials[i] = cred
+				r.verifyRepositories(svc, cred)
+			} else {
+				registryLog(cred.Host, "").Warnf("Received several tokens for the host, using the one expiring at %s", credentials[i].ExpiresAt)
+			}
+			continue
+		}
+		hosts[cred.Host] = len(credentials)
+		credentials = append(credentials, cred)
+		r.verifyRepositories(svc, cred)
+	}
+	// The expiry is taken from the kept tokens only, as duplicates may have
+	// been replaced
+	for _, cred := range credentials {
+		if !cred.ExpiresAt.IsZero() && (res.ExpiresAt.IsZero() || cred.ExpiresAt.Before(res.ExpiresAt)) {
+			res.ExpiresAt = cred.ExpiresAt
+		}
 	}
-}
 
-func (r *Rancher) processToken(
-	data *ecr.AuthorizationData,
-	registryClient client.RegistryOperations,
-	registryCredentialClient client.RegistryCredentialOperations) {
+	// Only hosts that pass the denylist and region filters are left for the
+	// poller to write between cycles
+	r.cached = []*ecrCredential{}
+	for _, cred := range credentials {
+		if !r.isDenied(cred.Host) && r.regionAllowed(cred.Host) {
+			r.cached = append(r.cached, cred)
+		}
+	}
 
-	bytes, err := base64.StdEncoding.DecodeString(*data.AuthorizationToken)
-	if err != nil {
-		log.Printf("[%s] Error decoding authorization token: %s\n", *data.ProxyEndpoint, err)
-		return
+	if window, ok := activeFreeze(r.FreezeWindows, time.Now()); ok {
+		log.Warnf("In freeze window %s, not writing the %d retrieved credentials\n", window, len(credentials))
+		res.Frozen = true
+		res.FreezeUntil = window.until(time.Now())
+		res.Skipped = len(credentials)
+		res.Err = r.cycleError(res)
+		return res
 	}
-	token := string(bytes[:len(bytes)])
 
-	authTokens := strings.Split(token, ":")
-	if len(authTokens) != 2 {
-		log.Printf("[%s] Authorization token does not contain data in <user>:<password> format: %s\n", *data.ProxyEndpoint, token)
-		return
+	var configured map[string]bool
+	if r.SkipUnconfiguredHosts {
+		configured = configuredHosts(ctx, writers)
 	}
 
-	registryURL, err := url.Parse(*data.ProxyEndpoint)
-	if err != nil {
-		log.Printf("[%s] Error parsing registry URL: %s\n", *data.ProxyEndpoint, err)
-		return
+	// Registries left over by a cycle that hit its deadline go first
+	sort.SliceStable(credentials, func(i, j int) bool {
+		return r.pending[credentials[i].Host] && !r.pending[credentials[j].Host]
+	})
+	pending := map[string]bool{}
+	audit := []auditRecord{}
+
+	for i, cred := range credentials {
+		if ctx.Err() != nil {
+			for _, left := range credentials[i:] {
+				pending[left.Host] = true
+			}
+			res.Remaining = len(credentials) - i
+			log.Warnf("Cycle deadline passed, deferring %d of %d registries to the next cycle\n", res.Remaining, len(credentials))
+			break
+		}
+		if r.isDenied(cred.Host) {
+			registryLog(cred.Host, "").Info("Skipping denylisted registry host")
+			res.Skipped++
+			continue
+		}
+		if !r.regionAllowed(cred.Host) {
+			registryLog(cred.Host, "").Infof("Skipping registry host in region %q outside ALLOWED_ECR_REGIONS", ecrRegion(cred.Host))
+			res.Skipped++
+			continue
+		}
+		if configured != nil && !configured[cred.Host] {
+			registryLog(cred.Host, "").Info("Skipping unconfigured registry host")
+			res.Skipped++
+			continue
+		}
+		if r.AuditOnly {
+			audit = append(audit, auditCredential(ctx, cred, writers))
+			continue
+		}
+		r.writeCredential(ctx, cred, writers, &res)
+	}
+	r.pending = pending
+	if r.AuditOnly {
+		storeAudit(audit)
+	}
+	log.Printf("Finished updating ECR credentials: %d updated, %d failed, %d skipped, %d unmatched %v, %d completed, %d remaining, %d undecodable, %d malformed tokens\n",
+		res.Updated, res.Failed, res.Skipped, len(res.Unmatched), res.Unmatched, len(credentials)-res.Remaining, res.Remaining, res.DecodeFailures, res.ParseFailures)
+	if r.DryRun {
+		log.Printf("Dry run: %d credential updates would have been made, none were written\n", res.WouldUpdate)
+	}
+
+	res.Err = r.cycleError(res)
+	return res
+}
+
+// cycleError returns the error that fails the cycle summarized by res, or nil
+func (r *Rancher) cycleError(res cycleResult) error {
+	switch {
+	case res.Failed > 0:
+		return fmt.Errorf("%d credential updates failed", res.Failed)
+	case len(res.FailedRegistryIDs) > 0:
+		return fmt.Errorf("no token for registry IDs %s", strings.Join(res.FailedRegistryIDs, ","))
+	case r.FailOnNoMatch && len(res.Unmatched) > 0:
+		return fmt.Errorf("no registry matches hosts %s", strings.Join(res.Unmatched, ","))
+	case r.StrictTokens && res.DecodeFailures+res.ParseFailures > 0:
+		return fmt.Errorf("%d authorization tokens could not be decoded", res.DecodeFailures+res.ParseFailures)
+	case r.StrictTokens && res.UsernameMismatches > 0:
+		return fmt.Errorf("%d authorization tokens have an unexpected username", res.UsernameMismatches)
+	case r.StrictTokens && res.TokenCountMismatch:
+		return errors.New("unexpected number of authorization tokens")
 	}
+	return nil
+}
 
-	ecrUsername := authTokens[0]
-	ecrPassword := authTokens[1]
-	ecrHost := registryURL.Host
+// keepDuplicate reports whether cred should replace kept, a token for the
+// same host received earlier in the cycle. With the "latest_expiry" policy the
+// token expiring last is used, otherwise the first one received.
+func (r *Rancher) keepDuplicate(kept, cred *ecrCredential) bool {
+	return r.DuplicateHostPolicy == "latest_expiry" && cred.ExpiresAt.After(kept.ExpiresAt)
+}
 
-	registries, err := registryClient.List(&client.ListOpts{})
-	if err != nil {
-		log.Printf("[%s] Failed to retrieve registries: %s\n", *data.ProxyEndpoint, err)
-		return
+// writeCredential hands cred to every writer in turn and records the outcomes
+// in res
+func (r *Rancher) writeCredential(ctx context.Context, cred *ecrCredential, writers []CredentialWriter, res *cycleResult) {
+	for _, writer := range writers {
+		err := writer.Write(ctx, cred.Host, cred.Username, cred.Password)
+		switch {
+		case err == errNoRegistry:
+			registryLog(cred.Host, "").Info("Failed to find registry to update")
+			res.Unmatched = append(res.Unmatched, cred.Host)
+		case err != nil:
+			registryLog(cred.Host, "").Error(err)
+			res.Failed++
+		case r.DryRun:
+			res.WouldUpdate++
+		default:
+			res.Updated++
+		}
 	}
-	log.Printf("[%s] Looking for configured registry for host: %s\n", *data.ProxyEndpoint, ecrHost)
-	for _, registry := range registries.Data {
-		serverAddress, err := url.Parse(registry.ServerAddress)
+}
+
+// isRegistryIDError reports whether a GetAuthorizationToken failure may be
+// caused by a single inaccessible or invalid registry ID in the request
+func isRegistryIDError(err error) bool {
+	if isAccessDenied(err) {
+		return true
+	}
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == "InvalidParameterException"
+}
+
+// getTokensPerRegistry requests a token for each registry ID separately, so a
+// bad ID does not prevent the others from being updated. It returns the
+// combined authorization data and the IDs that failed, and an error only if
+// every request failed.
+func getTokensPerRegistry(ctx context.Context, svc ecriface.ECRAPI, registryIDs []string) (*ecr.GetAuthorizationTokenOutput, []string, error) {
+	resp := &ecr.GetAuthorizationTokenOutput{}
+	failed := []string{}
+	var lastErr error
+	for _, id := range registryIDs {
+		var out *ecr.GetAuthorizationTokenOutput
+		err := retry(ctx, retryAttempts, retryBaseDelay, func() error {
+			var err error
+			out, err = svc.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{RegistryIds: aws.StringSlice([]string{id})})
+			return err
+		})
 		if err != nil {
-			log.Printf("[%s] Failed to parse configured registry URL: %s\n", *data.ProxyEndpoint, registry.ServerAddress)
-			break
+			log.WithField("registry_id", id).Warnf("Unable to get authorization token: %s", err)
+			failed = append(failed, id)
+			lastErr = err
+			continue
 		}
-		registryHost := serverAddress.Host
-		if registryHost == "" {
-			registryHost = serverAddress.Path
-		}
-		if registryHost == ecrHost {
-			credentials, err := registryCredentialClient.List(&client.ListOpts{
-				Filters: map[string]interface{}{
-					"registryId": registry.Id,
-				},
-			})
-			if err != nil {
-				log.Printf("[%s] Failed to retrieved registry credentials for id: %s, %s\n", *data.ProxyEndpoint, registry.Id, err)
-				break
-			}
-			if len(credentials.Data) != 1 {
-				log.Printf("[%s] No credentials retrieved for registry: %s\n", *data.ProxyEndpoint, registry.Id)
-				break
-			}
-			credential := credentials.Data[0]
-			_, err = registryCredentialClient.Update(&credential, &client.RegistryCredential{
-				PublicValue: ecrUsername,
-				SecretValue: ecrPassword,
-				Email:       "not-really@required.anymore",
-			})
-			if err != nil {
-				log.Printf("[%s] Failed to update registry credential %s, %s\n", *data.ProxyEndpoint, credential.Id, err)
-			} else {
-				log.Printf("[%s] Successfully updated credentials %s for registry %s; registry address: %s\n", *data.ProxyEndpoint, credential.Id, registry.Id, registryHost)
-			}
-			return
+		log.WithField("registry_id", id).Info("Got authorization token")
+		resp.AuthorizationData = append(resp.AuthorizationData, out.AuthorizationData...)
+	}
+	if len(failed) == len(registryIDs) {
+		return nil, failed, lastErr
+	}
+	return resp, failed, nil
+}
+
+// configuredHosts collects the registry hosts known to the writers that can
+// report them, such as Rancher. Writers that accept any host, such as the
+// token file, are left out. It returns nil, disabling the filter, if none of
+// the writers can report hosts.
+func configuredHosts(ctx context.Context, writers []CredentialWriter) map[string]bool {
+	var hosts map[string]bool
+	for _, writer := range writers {
+		lister, ok := writer.(hostLister)
+		if !ok {
+			continue
+		}
+		writerHosts, err := lister.Hosts(ctx)
+		if err != nil {
+			log.Printf("Unable to list configured registry hosts, processing all tokens: %s\n", err)
+			return nil
+		}
+		if hosts == nil {
+			hosts = map[string]bool{}
+		}
+		for host := range writerHosts {
+			hosts[host] = true
+		}
+	}
+	return hosts
+}
+
+// isDenied reports whether host is on the registry host denylist
+func (r *Rancher) isDenied(host string) bool {
+	host = strings.ToLower(host)
+	for _, denied := range r.HostDenylist {
+		if denied == host {
+			return true
+		}
+	}
+	return false
+}
+
+// regionAllowed reports whether host is in one of the allowed regions. Hosts
+// without a recognizable ECR region are only allowed when all regions are.
+func (r *Rancher) regionAllowed(host string) bool {
+	if len(r.AllowedRegions) == 0 {
+		return true
+	}
+	region := ecrRegion(host)
+	for _, allowed := range r.AllowedRegions {
+		if region != "" && strings.EqualFold(allowed, region) {
+			return true
 		}
 	}
-	log.Printf("[%s] Did not find an existing reigstry for host: %s\n", *data.ProxyEndpoint, ecrHost)
+	return false
+}
 
-	// If we made it this far, it means we were not able to find an existing registry to update in Rancher
-	if r.AutoCreate {
-		log.Printf("[%s] Automatically creating registry for host: %s\n", *data.ProxyEndpoint, ecrHost)
-		registry, err := registryClient.Create(&client.Registry{
-			ServerAddress: ecrHost,
+// logAWSError logs a failed AWS call, including the request ID, status code
+// and error code needed to open an AWS support case when they are available
+func logAWSError(operation string, err error) {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		log.WithFields(log.Fields{
+			"request_id":  reqErr.RequestID(),
+			"status_code": reqErr.StatusCode(),
+			"error_code":  reqErr.Code(),
+		}).Errorf("Error calling AWS %s API: %s\n", operation, reqErr.Message())
+		return
+	}
+	log.Printf("Error calling AWS API: %s\n", err)
+}
+
+// verifyRepositories warns about any configured repository that cannot be
+// described in the registry of the given credential
+func (r *Rancher) verifyRepositories(svc ecriface.ECRAPI, cred *ecrCredential) {
+	for _, repo := range r.VerifyRepositories {
+		_, err := svc.DescribeRepositories(&ecr.DescribeRepositoriesInput{
+			RegistryId:      aws.String(cred.RegistryID),
+			RepositoryNames: []*string{aws.String(repo)},
 		})
 		if err != nil {
-			log.Printf("[%s] Error creating registry for host: %s, %s\n", *data.ProxyEndpoint, ecrHost, err)
-			return
+			registryLog(cred.Host, "").Warnf("Repository %s is missing or inaccessible: %s", repo, err)
 		}
-		_, err = registryCredentialClient.Create(&client.RegistryCredential{
-			RegistryId:  registry.Id,
-			PublicValue: ecrUsername,
-			SecretValue: ecrPassword,
-			Email:       "not-really@required.anymore",
-		})
-		log.Printf("[%s] Successfully created regristy %s and updated credential\n", *data.ProxyEndpoint, registry.Id)
+	}
+}
 
-		if err != nil {
-			log.Printf("[%s] Error creating registry credential for host: %s, %s\n", *data.ProxyEndpoint, ecrHost, err)
-			return
+// ecrCredential holds the decoded login for a single ECR registry
+type ecrCredential struct {
+	Endpoint   string
+	RegistryID string
+	Host       string
+	Username   string
+	Password   string
+	ExpiresAt  time.Time
+}
+
+// errTokenFormat is returned for tokens that are not in <user>:<password>
+// format. It deliberately leaves out the token, which may hold a password.
+var errTokenFormat = errors.New("authorization token does not contain data in <user>:<password> format")
+
+// decodeToken extracts the registry host and login from an ECR authorization token
+func decodeToken(data *ecr.AuthorizationData) (*ecrCredential, error) {
+	if data == nil || aws.StringValue(data.AuthorizationToken) == "" {
+		return nil, fmt.Errorf("authorization data is missing an authorization token")
+	}
+	if aws.StringValue(data.ProxyEndpoint) == "" {
+		return nil, fmt.Errorf("authorization data is missing a proxy endpoint")
+	}
+
+	encoding := "padded"
+	bytes, err := base64.StdEncoding.DecodeString(aws.StringValue(data.AuthorizationToken))
+	if err != nil {
+		// Fall back to unpadded base64 in case the token padding was stripped
+		var rawErr error
+		bytes, rawErr = base64.RawStdEncoding.DecodeString(aws.StringValue(data.AuthorizationToken))
+		if rawErr != nil {
+			return nil, fmt.Errorf("error decoding authorization token: %s", err)
 		}
+		encoding = "unpadded"
+	}
+	token := string(bytes[:len(bytes)])
+
+	authTokens := strings.Split(token, ":")
+	if len(authTokens) != 2 {
+		return nil, errTokenFormat
+	}
+
+	registryURL, err := url.Parse(aws.StringValue(data.ProxyEndpoint))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing registry URL: %s", err)
+	}
+	registryLog(registryURL.Host, "").Debugf("Decoded authorization token using %s base64", encoding)
+
+	return &ecrCredential{
+		Endpoint:   aws.StringValue(data.ProxyEndpoint),
+		RegistryID: strings.SplitN(registryURL.Host, ".", 2)[0],
+		Host:       registryURL.Host,
+		Username:   authTokens[0],
+		Password:   authTokens[1],
+		ExpiresAt:  aws.TimeValue(data.ExpiresAt),
+	}, nil
+}
+
+// healthcheck serves the HTTP endpoints, using TLS when a certificate and key are given
+func healthcheck(cfg Config, server *http.Server) {
+	var err error
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+		log.Printf("Starting TLS Healthcheck listener at %s/ping\n", cfg.listenAddress())
+		err = server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
 	} else {
-		log.Printf("[%s] Failed to find Rancher registry to update for ECR Host: %s\n", *data.ProxyEndpoint, ecrHost)
+		log.Printf("Starting Healthcheck listener at %s/ping\n", cfg.listenAddress())
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		if cfg.RequireHTTP {
+			log.Fatal("Error creating health check listener: ", err)
+		}
+		log.Errorf("Error creating health check listener, continuing without it: %s\n", err)
 	}
-	return
 }
 
-func healthcheck() {
+// newHealthcheckServer registers the HTTP endpoints and returns the server
+// for them
+func newHealthcheckServer(cfg Config) *http.Server {
+	http.HandleFunc("/ping", probeMethods(ping))
+	http.HandleFunc("/readyz", probeMethods(readyz))
+	http.HandleFunc("/healthz", probeMethods(healthz))
+	http.HandleFunc("/schedule", probeMethods(scheduleStatus))
+	if cfg.AuditOnly {
+		http.HandleFunc("/status", status)
+	}
+	return &http.Server{
+		Addr:         cfg.listenAddress(),
+		ReadTimeout:  cfg.HTTPReadTimeout,
+		WriteTimeout: cfg.HTTPWriteTimeout,
+		IdleTimeout:  cfg.HTTPIdleTimeout,
+	}
+}
 
-	listenPort := "8080"
-	p, ok := os.LookupEnv("LISTEN_PORT")
-	if ok {
-		listenPort = p
+// probe requests the /ping endpoint of the instance listening on the
+// configured port, so container healthchecks need no extra tools
+func probe(cfg Config) error {
+	scheme := "http"
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+		// The certificate is issued for the service name, not the loopback address
+		scheme = "https"
+		httpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
 	}
-	http.HandleFunc("/ping", ping)
-	log.Printf("Starting Healthcheck listener at :%s/ping\n", listenPort)
-	err := http.ListenAndServe(fmt.Sprintf(":%s", listenPort), nil)
+	host := cfg.ListenHost
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	resp, err := httpClient.Get(fmt.Sprintf("%s://%s/ping", scheme, net.JoinHostPort(host, cfg.ListenPort)))
 	if err != nil {
-		log.Fatal("Error creating health check listener: ", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
 	}
+	return nil
 }
 
 func ping(w http.ResponseWriter, r *http.Request) {
@@ -236,17 +1025,51 @@ func ping(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "pong!")
 }
 
-func awsClient() *ecr.ECR {
-	roleArn, ok := os.LookupEnv("AWS_ROLE_ARN")
-	if ok {
-		log.Printf("[awsClient] Assuming Role: %s\n", roleArn)
-		return ecr.New(
-			session.New(
-				aws.NewConfig().WithCredentials(
-					stscreds.NewCredentials(session.New(), roleArn),
-				),
+// probeMethods restricts a probe handler to GET and HEAD requests, answering
+// HEAD requests with the status of a GET but no body
+func probeMethods(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			h(w, r)
+		case http.MethodHead:
+			h(headWriter{w}, r)
+		default:
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// headWriter discards the body written by a handler
+type headWriter struct {
+	http.ResponseWriter
+}
+
+func (w headWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func awsClient(cfg Config) *ecr.ECR {
+	ecrCfg := ecrConfig(cfg)
+	if cfg.ECREndpoint != "" {
+		log.Debugf("[awsClient] Using ECR endpoint: %s\n", cfg.ECREndpoint)
+		ecrCfg = ecrCfg.WithEndpoint(cfg.ECREndpoint)
+	}
+	return ecr.New(awsSession(cfg), ecrCfg)
+}
+
+// awsSession returns a session using the default credential chain, assuming
+// the configured role when set
+func awsSession(cfg Config) *session.Session {
+	if cfg.RoleArn != "" {
+		stsSession := session.New(stsConfig(cfg))
+		log.Printf("[awsClient] Assuming Role: %s via STS endpoint %s\n", cfg.RoleArn, stsSession.ClientConfig("sts").Endpoint)
+		return session.New(
+			aws.NewConfig().WithCredentials(
+				stscreds.NewCredentials(stsSession, cfg.RoleArn),
 			),
 		)
 	}
-	return ecr.New(session.New())
+	return session.New()
 }
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/rancher/go-rancher/client"
 	"github.com/rancher/rancher-ecr-credentials/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestMain_basic(t *testing.T) {
@@ -56,7 +66,12 @@ func TestMain_basic(t *testing.T) {
 		Email:       "not-really@required.anymore",
 	}).Return(&client.RegistryCredential{}, nil)
 
-	r.updateEcr(mockEcr, mockRegistry, mockRegistryCredential)
+	r.updateEcr(context.Background(), mockEcr, []CredentialWriter{
+		&RancherWriter{
+			Registries:  mockRegistry,
+			Credentials: mockRegistryCredential,
+		},
+	})
 
 	mockEcr.AssertExpectations(t)
 	mockRegistry.AssertExpectations(t)
@@ -64,9 +79,7 @@ func TestMain_basic(t *testing.T) {
 }
 
 func TestMain_autoCreate(t *testing.T) {
-	r := &Rancher{
-		AutoCreate: true,
-	}
+	r := &Rancher{}
 	mockEcr := new(mocks.ECRAPI)
 	mockRegistry := new(mocks.RegistryOperations)
 	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
@@ -111,9 +124,721 @@ func TestMain_autoCreate(t *testing.T) {
 		Email:       "not-really@required.anymore",
 	}, nil)
 
-	r.updateEcr(mockEcr, mockRegistry, mockRegistryCredential)
+	r.updateEcr(context.Background(), mockEcr, []CredentialWriter{
+		&RancherWriter{
+			Registries:  mockRegistry,
+			Credentials: mockRegistryCredential,
+			AutoCreate:  true,
+		},
+	})
 
 	mockEcr.AssertExpectations(t)
 	mockRegistry.AssertExpectations(t)
 	mockRegistryCredential.AssertExpectations(t)
 }
+
+func TestMain_blankServerAddress(t *testing.T) {
+	r := &Rancher{}
+	mockEcr := new(mocks.ECRAPI)
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+			},
+		}, nil)
+
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{
+					Resource: client.Resource{
+						Id: "1r1",
+					},
+					ServerAddress: "",
+				},
+			},
+		},
+		nil,
+	)
+
+	r.updateEcr(context.Background(), mockEcr, []CredentialWriter{
+		&RancherWriter{
+			Registries:  mockRegistry,
+			Credentials: mockRegistryCredential,
+		},
+	})
+
+	mockEcr.AssertExpectations(t)
+	mockRegistry.AssertExpectations(t)
+	mockRegistryCredential.AssertNotCalled(t, "List", mock.Anything)
+}
+
+func TestMain_verifyRepositories(t *testing.T) {
+	r := &Rancher{
+		VerifyRepositories: []string{"present", "missing"},
+	}
+	mockEcr := new(mocks.ECRAPI)
+	mockWriter := new(mocks.CredentialWriter)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+			},
+		}, nil)
+	mockEcr.On("DescribeRepositories", &ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String("012345678910"),
+		RepositoryNames: []*string{aws.String("present")},
+	}).Return(&ecr.DescribeRepositoriesOutput{}, nil)
+	mockEcr.On("DescribeRepositories", &ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String("012345678910"),
+		RepositoryNames: []*string{aws.String("missing")},
+	}).Return(nil, errors.New("RepositoryNotFoundException"))
+	mockWriter.On("Write", mock.Anything, "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword").Return(nil)
+
+	r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+
+	mockEcr.AssertExpectations(t)
+	mockWriter.AssertExpectations(t)
+}
+
+func TestMain_hostDenylist(t *testing.T) {
+	r := &Rancher{
+		HostDenylist: []string{"012345678910.dkr.ecr.us-east-1.amazonaws.com"},
+	}
+	mockEcr := new(mocks.ECRAPI)
+	mockWriter := new(mocks.CredentialWriter)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+			},
+		}, nil)
+
+	r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+
+	mockEcr.AssertExpectations(t)
+	mockWriter.AssertNotCalled(t, "Write", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRancher_isDenied(t *testing.T) {
+	denylist, err := splitHosts(" HTTPS://012345678910.DKR.ecr.us-east-1.amazonaws.com/, 109876543210.dkr.ecr.us-west-2.amazonaws.com/ecr-public")
+	assert.NoError(t, err)
+	r := &Rancher{HostDenylist: denylist}
+
+	assert.True(t, r.isDenied("012345678910.dkr.ecr.us-east-1.amazonaws.com"))
+	assert.True(t, r.isDenied("109876543210.dkr.ecr.us-west-2.amazonaws.com"))
+	assert.False(t, r.isDenied("555555555555.dkr.ecr.us-east-1.amazonaws.com"))
+}
+
+func TestMain_skipUnconfiguredHosts(t *testing.T) {
+	r := &Rancher{
+		SkipUnconfiguredHosts: true,
+	}
+	mockEcr := new(mocks.ECRAPI)
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+			},
+		}, nil)
+
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{
+					Resource: client.Resource{
+						Id: "1r1",
+					},
+					ServerAddress: "registry.example.com",
+				},
+			},
+		},
+		nil,
+	)
+
+	r.updateEcr(context.Background(), mockEcr, []CredentialWriter{
+		&RancherWriter{
+			Registries:  mockRegistry,
+			Credentials: mockRegistryCredential,
+			AutoCreate:  true,
+		},
+	})
+
+	mockEcr.AssertExpectations(t)
+	mockRegistry.AssertNumberOfCalls(t, "List", 1)
+	mockRegistry.AssertNotCalled(t, "Create", mock.Anything)
+}
+
+func TestConfiguredHosts(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{
+					Resource:      client.Resource{Id: "1r1"},
+					ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+				},
+			},
+		},
+		nil,
+	)
+	rancher := &RancherWriter{Registries: mockRegistry, Credentials: new(mocks.RegistryCredentialOperations)}
+	file := &FileWriter{Path: "/nonexistent/auths.json"}
+
+	// Writers that accept any host do not disable the filter
+	assert.Equal(t, map[string]bool{"012345678910.dkr.ecr.us-east-1.amazonaws.com": true},
+		configuredHosts(context.Background(), []CredentialWriter{rancher, file}))
+	assert.Nil(t, configuredHosts(context.Background(), []CredentialWriter{file}))
+}
+
+func TestMain_malformedAuthorizationData(t *testing.T) {
+	r := &Rancher{}
+	mockEcr := new(mocks.ECRAPI)
+	mockWriter := new(mocks.CredentialWriter)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				nil,
+				&ecr.AuthorizationData{
+					ProxyEndpoint: aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+				},
+				&ecr.AuthorizationData{
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(""),
+				},
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockPassword"))),
+				},
+			},
+		}, nil)
+
+	res := r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+
+	mockEcr.AssertExpectations(t)
+	mockWriter.AssertNotCalled(t, "Write", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(t, 4, res.DecodeFailures)
+	assert.Equal(t, 1, res.ParseFailures)
+	assert.NoError(t, res.Err)
+
+	r.StrictTokens = true
+	res = r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+
+	assert.Error(t, res.Err)
+}
+
+func TestMain_checkTokenCount(t *testing.T) {
+	r := &Rancher{RegistryIds: []string{"012345678910", "109876543210"}, CheckTokenCount: true}
+	mockEcr := new(mocks.ECRAPI)
+	mockWriter := new(mocks.CredentialWriter)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{
+		RegistryIds: aws.StringSlice([]string{"012345678910", "109876543210"}),
+	}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+			},
+		}, nil)
+	mockWriter.On("Write", mock.Anything, "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword").Return(nil)
+
+	res := r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+
+	assert.True(t, res.TokenCountMismatch)
+	assert.Equal(t, 1, res.Updated)
+	assert.NoError(t, res.Err)
+
+	r.StrictTokens = true
+	res = r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+
+	assert.Error(t, res.Err)
+}
+
+func TestMain_duplicateHosts(t *testing.T) {
+	mockEcr := new(mocks.ECRAPI)
+	now := time.Now()
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:firstPassword"))),
+					ExpiresAt:          aws.Time(now.Add(6 * time.Hour)),
+				},
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:laterPassword"))),
+					ExpiresAt:          aws.Time(now.Add(12 * time.Hour)),
+				},
+			},
+		}, nil)
+
+	for policy, kept := range map[string]struct {
+		password  string
+		expiresAt time.Time
+	}{
+		"first":         {"firstPassword", now.Add(6 * time.Hour)},
+		"latest_expiry": {"laterPassword", now.Add(12 * time.Hour)},
+	} {
+		r := &Rancher{DuplicateHostPolicy: policy}
+		mockWriter := new(mocks.CredentialWriter)
+		mockWriter.On("Write", mock.Anything, "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", kept.password).Return(nil)
+
+		res := r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+
+		assert.NoError(t, res.Err, policy)
+		assert.Equal(t, 1, res.Updated, policy)
+		assert.True(t, kept.expiresAt.Equal(res.ExpiresAt), policy)
+		mockWriter.AssertNumberOfCalls(t, "Write", 1)
+	}
+}
+
+func TestNewRancher_invalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		Config{},
+		Config{URL: "http://rancher.example.com"},
+		Config{URL: "http://rancher.example.com", AccessKey: "access"},
+		Config{URL: "http://rancher.example.com", SecretKey: "secret"},
+	} {
+		r, err := NewRancher(context.Background(), cfg)
+		assert.Error(t, err)
+		assert.Nil(t, r)
+	}
+}
+
+func TestNewClient_cancelled(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Minute
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := &Rancher{URL: server.URL, AccessKey: "access", SecretKey: "secret"}
+	_, err := r.newClient(ctx, false)
+
+	// Retrying stops once the shutdown context is done
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestCheckRancherAccess(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		contains string
+	}{
+		{nil, ""},
+		{&client.ApiError{StatusCode: 401, Status: "401 Unauthorized"}, "authentication failed"},
+		{&client.ApiError{StatusCode: 403, Status: "403 Forbidden"}, "not permitted"},
+		{&client.ApiError{StatusCode: 404, Status: "404 Not Found"}, "CATTLE_URL"},
+		{&url.Error{Op: "Get", URL: "http://rancher", Err: errors.New("connection refused")}, "unable to reach Rancher"},
+	} {
+		mockRegistry := new(mocks.RegistryOperations)
+		mockRegistry.On("List", &client.ListOpts{}).Return(&client.RegistryCollection{}, test.err)
+
+		err := checkRancherAccess(mockRegistry)
+
+		if test.err == nil {
+			assert.NoError(t, err)
+		} else {
+			assert.Contains(t, err.Error(), test.contains)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(ping))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	assert.NoError(t, probe(Config{ListenPort: serverURL.Port()}))
+
+	server.Close()
+	assert.Error(t, probe(Config{ListenPort: serverURL.Port()}))
+}
+
+func TestDecodeToken_hosts(t *testing.T) {
+	token := aws.String(base64.StdEncoding.EncodeToString([]byte("AWS:mockPassword")))
+	for endpoint, want := range map[string]ecrCredential{
+		"https://012345678910.dkr.ecr.us-east-1.amazonaws.com": ecrCredential{
+			RegistryID: "012345678910",
+			Host:       "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+		},
+		"https://012345678910.dkr.ecr-fips.us-gov-west-1.amazonaws.com": ecrCredential{
+			RegistryID: "012345678910",
+			Host:       "012345678910.dkr.ecr-fips.us-gov-west-1.amazonaws.com",
+		},
+		"https://012345678910.dkr.ecr.cn-north-1.amazonaws.com.cn": ecrCredential{
+			RegistryID: "012345678910",
+			Host:       "012345678910.dkr.ecr.cn-north-1.amazonaws.com.cn",
+		},
+	} {
+		cred, err := decodeToken(&ecr.AuthorizationData{
+			ProxyEndpoint:      aws.String(endpoint),
+			AuthorizationToken: token,
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, want.RegistryID, cred.RegistryID, endpoint)
+		assert.Equal(t, want.Host, cred.Host, endpoint)
+		assert.Equal(t, "AWS", cred.Username)
+		assert.Equal(t, "mockPassword", cred.Password)
+	}
+}
+
+func TestDecodeToken_formatErrorOmitsToken(t *testing.T) {
+	_, err := decodeToken(&ecr.AuthorizationData{
+		ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+		AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockPassword"))),
+	})
+
+	assert.Equal(t, errTokenFormat, err)
+	assert.NotContains(t, err.Error(), "mockPassword")
+}
+
+func TestDecodeToken_unpadded(t *testing.T) {
+	// "mockUser:mockPasswd" needs padding in standard base64
+	token := base64.RawStdEncoding.EncodeToString([]byte("mockUser:mockPasswd"))
+	assert.NotEqual(t, base64.StdEncoding.EncodeToString([]byte("mockUser:mockPasswd")), token)
+
+	cred, err := decodeToken(&ecr.AuthorizationData{
+		ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+		AuthorizationToken: aws.String(token),
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "mockUser", cred.Username)
+	assert.Equal(t, "mockPasswd", cred.Password)
+}
+
+func TestMain_cycleDeadline(t *testing.T) {
+	r := &Rancher{}
+	mockEcr := new(mocks.ECRAPI)
+	mockWriter := new(mocks.CredentialWriter)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://109876543210.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+			},
+		}, nil)
+	mockWriter.On("Write", mock.Anything, mock.Anything, "mockUser", "mockPassword").Return(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res := r.updateEcr(ctx, mockEcr, []CredentialWriter{mockWriter})
+
+	assert.Equal(t, 2, res.Remaining)
+	mockWriter.AssertNotCalled(t, "Write", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	r.pending = map[string]bool{"109876543210.dkr.ecr.us-east-1.amazonaws.com": true}
+	res = r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+
+	assert.Equal(t, 0, res.Remaining)
+	assert.Equal(t, 2, res.Updated)
+	assert.Equal(t, "109876543210.dkr.ecr.us-east-1.amazonaws.com", mockWriter.Calls[0].Arguments.String(1))
+}
+
+func TestAllowRegistryIDs(t *testing.T) {
+	ids, err := allowRegistryIDs([]string{"012345678910", "109876543210"}, []string{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"012345678910", "109876543210"}, ids)
+
+	ids, err = allowRegistryIDs([]string{"012345678910", "109876543210"}, []string{"109876543210"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"109876543210"}, ids)
+
+	_, err = allowRegistryIDs([]string{"012345678910"}, []string{"109876543210"})
+	assert.Error(t, err)
+
+	_, err = allowRegistryIDs([]string{}, []string{"109876543210"})
+	assert.Error(t, err)
+}
+
+func TestCheckRegistryAccounts(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{Resource: client.Resource{Id: "1r1"}, AccountId: "1a5"},
+				client.Registry{Resource: client.Resource{Id: "1r2"}, AccountId: "1a7"},
+				client.Registry{Resource: client.Resource{Id: "1r3"}, AccountId: "1a9"},
+			},
+		},
+		nil,
+	)
+
+	assert.NoError(t, checkRegistryAccounts(mockRegistry, []string{"1a5", "1a7", "1a9"}))
+	assert.EqualError(t, checkRegistryAccounts(mockRegistry, []string{"1a5"}),
+		"API key can see registries in accounts outside ALLOWED_ACCOUNT_IDS: 1a7,1a9")
+}
+
+func TestMain_multipleWriters(t *testing.T) {
+	r := &Rancher{}
+	mockEcr := new(mocks.ECRAPI)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+			},
+		}, nil)
+	writers := []CredentialWriter{}
+	for _, err := range []error{nil, errNoRegistry, errors.New("boom"), nil} {
+		mockWriter := new(mocks.CredentialWriter)
+		mockWriter.On("Write", mock.Anything, "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword").Return(err)
+		writers = append(writers, mockWriter)
+	}
+
+	res := r.updateEcr(context.Background(), mockEcr, writers)
+
+	assert.Equal(t, 2, res.Updated)
+	assert.Equal(t, 1, res.Failed)
+	assert.Equal(t, []string{"012345678910.dkr.ecr.us-east-1.amazonaws.com"}, res.Unmatched)
+	for _, writer := range writers {
+		writer.(*mocks.CredentialWriter).AssertNumberOfCalls(t, "Write", 1)
+	}
+}
+
+func TestMain_failOnNoMatch(t *testing.T) {
+	mockEcr := new(mocks.ECRAPI)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+			},
+		}, nil)
+	mockWriter := new(mocks.CredentialWriter)
+	mockWriter.On("Write", mock.Anything, "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword").Return(errNoRegistry)
+
+	r := &Rancher{}
+	res := r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+	assert.NoError(t, res.Err)
+
+	r.FailOnNoMatch = true
+	res = r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+	assert.EqualError(t, res.Err, "no registry matches hosts 012345678910.dkr.ecr.us-east-1.amazonaws.com")
+}
+
+func TestMain_unexpectedUsername(t *testing.T) {
+	mockEcr := new(mocks.ECRAPI)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+			},
+		}, nil)
+
+	for _, skip := range []bool{false, true} {
+		r := &Rancher{ExpectedUsername: "AWS", SkipUnexpectedUsername: skip}
+		mockWriter := new(mocks.CredentialWriter)
+		mockWriter.On("Write", mock.Anything, mock.Anything, "mockUser", "mockPassword").Return(nil)
+
+		res := r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+
+		assert.Equal(t, 1, res.UsernameMismatches)
+		assert.NoError(t, res.Err)
+		if skip {
+			mockWriter.AssertNotCalled(t, "Write", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		} else {
+			mockWriter.AssertNumberOfCalls(t, "Write", 1)
+		}
+	}
+}
+
+func TestMain_unexpectedUsernameStrict(t *testing.T) {
+	mockEcr := new(mocks.ECRAPI)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+			},
+		}, nil)
+	mockWriter := new(mocks.CredentialWriter)
+	mockWriter.On("Write", mock.Anything, mock.Anything, "mockUser", "mockPassword").Return(nil)
+	notifier := &fakeNotifier{}
+	alerts := &cycleAlerts{notifier: notifier}
+
+	r := &Rancher{ExpectedUsername: "AWS"}
+	res := r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+	alerts.observe(context.Background(), res.Err)
+
+	assert.NoError(t, res.Err)
+	assert.Empty(t, notifier.failures)
+
+	r.StrictTokens = true
+	res = r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+	alerts.observe(context.Background(), res.Err)
+
+	assert.EqualError(t, res.Err, "1 authorization tokens have an unexpected username")
+	assert.Equal(t, []error{res.Err}, notifier.failures)
+}
+
+func TestCheckECRAccess(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		contains string
+	}{
+		{nil, ""},
+		{awserr.NewRequestFailure(awserr.New("AccessDeniedException", "not authorized", nil), 400, "req-1"), "not permitted"},
+		{awserr.NewRequestFailure(awserr.New("ServerException", "internal", nil), 500, "req-2"), "unexpected AWS response"},
+		{awserr.New("RequestError", "send request failed", errors.New("dial tcp: i/o timeout")), "unable to reach ECR"},
+		{awserr.New("NoCredentialProviders", "no valid providers in chain", nil), "no AWS credentials"},
+	} {
+		mockEcr := new(mocks.ECRAPI)
+		mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{
+			RegistryIds: aws.StringSlice([]string{"012345678910"}),
+		}).Return(&ecr.GetAuthorizationTokenOutput{}, test.err)
+
+		err := checkECRAccess(mockEcr, []string{"012345678910"})
+
+		if test.err == nil {
+			assert.NoError(t, err)
+		} else {
+			assert.Contains(t, err.Error(), test.contains)
+		}
+	}
+}
+
+func TestUtcFormatter(t *testing.T) {
+	f := utcFormatter{&log.TextFormatter{FullTimestamp: true, TimestampFormat: time.RFC3339, DisableColors: true}}
+	entry := log.NewEntry(log.New())
+	entry.Time = time.Date(2017, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+	entry.Message = "hello"
+
+	out, err := f.Format(entry)
+
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `time="2017-03-01T11:00:00Z"`)
+}
+
+func TestMain_partialRegistryIDFailure(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	r := &Rancher{RegistryIds: []string{"012345678910", "109876543210"}}
+	mockEcr := new(mocks.ECRAPI)
+	mockWriter := new(mocks.CredentialWriter)
+	denied := awserr.NewRequestFailure(awserr.New("AccessDeniedException", "not authorized", nil), 400, "req-1")
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{
+		RegistryIds: aws.StringSlice([]string{"012345678910", "109876543210"}),
+	}).Return(nil, denied)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{
+		RegistryIds: aws.StringSlice([]string{"012345678910"}),
+	}).Return(&ecr.GetAuthorizationTokenOutput{
+		AuthorizationData: []*ecr.AuthorizationData{
+			&ecr.AuthorizationData{
+				ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+				AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+			},
+		},
+	}, nil)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{
+		RegistryIds: aws.StringSlice([]string{"109876543210"}),
+	}).Return(nil, denied)
+	mockWriter.On("Write", mock.Anything, "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword").Return(nil)
+
+	res := r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+
+	assert.Equal(t, 1, res.Updated)
+	assert.Equal(t, []string{"109876543210"}, res.FailedRegistryIDs)
+	assert.Error(t, res.Err)
+	mockWriter.AssertNumberOfCalls(t, "Write", 1)
+}
+
+func TestRegionAllowed(t *testing.T) {
+	all := &Rancher{}
+	assert.True(t, all.regionAllowed("012345678910.dkr.ecr.eu-west-1.amazonaws.com"))
+
+	r := &Rancher{AllowedRegions: []string{"us-east-1", "us-west-2"}}
+	for host, allowed := range map[string]bool{
+		"012345678910.dkr.ecr.us-east-1.amazonaws.com":      true,
+		"012345678910.dkr.ecr-fips.us-west-2.amazonaws.com": true,
+		"012345678910.dkr.ecr.cn-north-1.amazonaws.com.cn":  false,
+		"012345678910.dkr.ecr.eu-west-1.amazonaws.com":      false,
+		"localhost:4510": false,
+	} {
+		assert.Equal(t, allowed, r.regionAllowed(host), host)
+	}
+}
+
+func TestProbeMethods(t *testing.T) {
+	handler := probeMethods(ping)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/ping", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "pong!", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("HEAD", "/ping", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/ping", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET, HEAD", rec.Header().Get("Allow"))
+}
+
+func TestMain_dryRunCounts(t *testing.T) {
+	r := &Rancher{DryRun: true}
+	mockEcr := new(mocks.ECRAPI)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("mockUser:mockPassword"))),
+				},
+			},
+		}, nil)
+	mockWriter := new(mocks.CredentialWriter)
+	mockWriter.On("Write", mock.Anything, "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword").Return(nil)
+
+	res := r.updateEcr(context.Background(), mockEcr, []CredentialWriter{mockWriter})
+
+	assert.NoError(t, res.Err)
+	assert.True(t, res.DryRun)
+	assert.Equal(t, 0, res.Updated)
+	assert.Equal(t, 1, res.WouldUpdate)
+}
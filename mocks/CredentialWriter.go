@@ -0,0 +1,23 @@
+package mocks
+
+import context "context"
+import mock "github.com/stretchr/testify/mock"
+
+// CredentialWriter is an autogenerated mock type for the CredentialWriter type
+type CredentialWriter struct {
+	mock.Mock
+}
+
+// Write provides a mock function with given fields: ctx, host, username, password
+func (_m *CredentialWriter) Write(ctx context.Context, host string, username string, password string) error {
+	ret := _m.Called(ctx, host, username, password)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) error); ok {
+		r0 = rf(ctx, host, username, password)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
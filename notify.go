@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// notifyTimeout bounds each notification request
+const notifyTimeout = 10 * time.Second
+
+// Notifier reports update cycle failures and recoveries to an external channel
+type Notifier interface {
+	// NotifyFailure is called when an update cycle fails after a successful one
+	NotifyFailure(ctx context.Context, err error) error
+	// NotifyRecovery is called when an update cycle succeeds after failedCycles
+	// consecutive failures
+	NotifyRecovery(ctx context.Context, failedCycles int) error
+}
+
+// newNotifier returns the notifiers enabled in cfg composed into one, or a
+// no-op notifier when none is configured
+func newNotifier(cfg Config) Notifier {
+	notifiers := multiNotifier{}
+	if cfg.NotifyWebhookURL != "" {
+		notifiers = append(notifiers, &WebhookNotifier{URL: cfg.NotifyWebhookURL})
+	}
+	if cfg.NotifySlackURL != "" {
+		notifiers = append(notifiers, &SlackNotifier{URL: cfg.NotifySlackURL})
+	}
+	switch len(notifiers) {
+	case 0:
+		return noopNotifier{}
+	case 1:
+		return notifiers[0]
+	}
+	return notifiers
+}
+
+// noopNotifier discards every notification
+type noopNotifier struct{}
+
+func (noopNotifier) NotifyFailure(ctx context.Context, err error) error         { return nil }
+func (noopNotifier) NotifyRecovery(ctx context.Context, failedCycles int) error { return nil }
+
+// multiNotifier sends each notification to all of its notifiers
+type multiNotifier []Notifier
+
+func (m multiNotifier) NotifyFailure(ctx context.Context, err error) error {
+	return m.each(func(n Notifier) error { return n.NotifyFailure(ctx, err) })
+}
+
+func (m multiNotifier) NotifyRecovery(ctx context.Context, failedCycles int) error {
+	return m.each(func(n Notifier) error { return n.NotifyRecovery(ctx, failedCycles) })
+}
+
+// each calls fn for every notifier, returning the first error after all of
+// them have been tried
+func (m multiNotifier) each(fn func(Notifier) error) error {
+	var first error
+	for _, n := range m {
+		if err := fn(n); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// WebhookNotifier posts a JSON event to a generic webhook URL
+type WebhookNotifier struct {
+	URL string
+}
+
+// webhookEvent is the body posted by WebhookNotifier
+type webhookEvent struct {
+	Event        string `json:"event"`
+	Message      string `json:"message"`
+	FailedCycles int    `json:"failed_cycles,omitempty"`
+}
+
+// NotifyFailure posts a failure event
+func (n *WebhookNotifier) NotifyFailure(ctx context.Context, err error) error {
+	return postJSON(ctx, n.URL, webhookEvent{
+		Event:   "failure",
+		Message: fmt.Sprintf("ECR credential update failed: %s", err),
+	})
+}
+
+// NotifyRecovery posts a recovery event
+func (n *WebhookNotifier) NotifyRecovery(ctx context.Context, failedCycles int) error {
+	return postJSON(ctx, n.URL, webhookEvent{
+		Event:        "recovery",
+		Message:      fmt.Sprintf("ECR credential updates recovered after %d failed cycles", failedCycles),
+		FailedCycles: failedCycles,
+	})
+}
+
+// SlackNotifier posts a message to a Slack incoming webhook URL
+type SlackNotifier struct {
+	URL string
+}
+
+// slackMessage is the body posted by SlackNotifier
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// NotifyFailure posts a failure message
+func (n *SlackNotifier) NotifyFailure(ctx context.Context, err error) error {
+	return postJSON(ctx, n.URL, slackMessage{
+		Text: fmt.Sprintf(":x: ECR credential update failed: %s", err),
+	})
+}
+
+// NotifyRecovery posts a recovery message
+func (n *SlackNotifier) NotifyRecovery(ctx context.Context, failedCycles int) error {
+	return postJSON(ctx, n.URL, slackMessage{
+		Text: fmt.Sprintf(":white_check_mark: ECR credential updates recovered after %d failed cycles", failedCycles),
+	})
+}
+
+// postJSON posts body encoded as JSON to url, failing on non-2xx responses
+func postJSON(ctx context.Context, url string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notification to %s failed: %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
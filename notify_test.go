@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewNotifier(t *testing.T) {
+	assert.Equal(t, noopNotifier{}, newNotifier(Config{}))
+	assert.Equal(t, &SlackNotifier{URL: "https://hooks.slack.test/x"}, newNotifier(Config{NotifySlackURL: "https://hooks.slack.test/x"}))
+	assert.Len(t, newNotifier(Config{NotifyWebhookURL: "https://hook.test", NotifySlackURL: "https://hooks.slack.test/x"}), 2)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	events := []webhookEvent{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		events = append(events, event)
+	}))
+	defer server.Close()
+
+	n := &WebhookNotifier{URL: server.URL}
+	assert.NoError(t, n.NotifyFailure(context.Background(), errors.New("boom")))
+	assert.NoError(t, n.NotifyRecovery(context.Background(), 3))
+
+	assert.Equal(t, []webhookEvent{
+		{Event: "failure", Message: "ECR credential update failed: boom"},
+		{Event: "recovery", Message: "ECR credential updates recovered after 3 failed cycles", FailedCycles: 3},
+	}, events)
+}
+
+func TestSlackNotifier_errorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid_token", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	n := &SlackNotifier{URL: server.URL}
+	assert.Error(t, n.NotifyRecovery(context.Background(), 1))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/client"
+)
+
+// registryPoller looks for registries added to Rancher between update cycles
+// and writes the tokens retrieved by the last cycle to them
+type registryPoller struct {
+	writer *RancherWriter
+	// known holds the IDs of the registries seen by the previous listing
+	known map[string]bool
+}
+
+// baseline records the registries that currently exist, so that only
+// registries added after it are picked up by poll
+func (p *registryPoller) baseline(ctx context.Context) {
+	registries, err := p.writer.listRegistries(ctx)
+	if err != nil {
+		log.Warnf("Unable to list registries for polling: %s\n", err)
+		p.known = nil
+		return
+	}
+	p.known = map[string]bool{}
+	for _, registry := range registries {
+		p.known[registry.Id] = true
+	}
+}
+
+// poll lists the registries and writes each of credentials that has not
+// expired by now to the registries added since the previous listing
+func (p *registryPoller) poll(ctx context.Context, credentials []*ecrCredential, now time.Time) {
+	if p.known == nil {
+		p.baseline(ctx)
+		return
+	}
+	registries, err := p.writer.listRegistries(ctx)
+	if err != nil {
+		log.Warnf("Unable to list registries for polling: %s\n", err)
+		return
+	}
+	added := []string{}
+	for _, registry := range registries {
+		if !p.known[registry.Id] {
+			added = append(added, registry.Id)
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+	log.Infof("Found %d registries added since the last poll: %v\n", len(added), added)
+
+	failed := false
+	for _, cred := range credentials {
+		if !cred.ExpiresAt.IsZero() && !now.Before(cred.ExpiresAt) {
+			continue
+		}
+		if !p.matchesAdded(registries, cred.Host) {
+			continue
+		}
+		registryLog(cred.Host, "").Info("Writing the cached token to newly added registries")
+		if err := p.writer.Write(ctx, cred.Host, cred.Username, cred.Password); err != nil {
+			registryLog(cred.Host, "").Errorf("Unable to write the cached token: %s", err)
+			failed = true
+		}
+	}
+	// Leave the added registries unknown so the next poll retries them
+	if failed {
+		return
+	}
+	for _, registry := range registries {
+		p.known[registry.Id] = true
+	}
+}
+
+// matchesAdded reports whether any registry not yet known matches host
+func (p *registryPoller) matchesAdded(registries []client.Registry, host string) bool {
+	matches, _ := p.writer.match(registries, host)
+	for _, registry := range matches {
+		if !p.known[registry.Id] {
+			return true
+		}
+	}
+	return false
+}
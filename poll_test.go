@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/rancher/go-rancher/client"
+	"github.com/rancher/rancher-ecr-credentials/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRegistryPoller_poll(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	existing := client.Registry{Resource: client.Resource{Id: "1r1"}, ServerAddress: "registry.example.com"}
+	added := client.Registry{Resource: client.Resource{Id: "1r2"}, ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com"}
+	addedExpired := client.Registry{Resource: client.Resource{Id: "1r3"}, ServerAddress: "109876543210.dkr.ecr.us-east-1.amazonaws.com"}
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{Data: []client.Registry{existing}}, nil).Once()
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{Data: []client.Registry{existing, added, addedExpired}}, nil)
+	credential := client.RegistryCredential{Resource: client.Resource{Id: "1rc2"}, RegistryId: "1r2"}
+	mockRegistryCredential.On("List", &client.ListOpts{Filters: map[string]interface{}{"registryId": "1r2"}}).Return(
+		&client.RegistryCredentialCollection{Data: []client.RegistryCredential{credential}}, nil)
+	mockRegistryCredential.On("Update", &credential, mock.Anything).Return(&credential, nil)
+
+	p := &registryPoller{writer: &RancherWriter{Registries: mockRegistry, Credentials: mockRegistryCredential}}
+	now := time.Now()
+	credentials := []*ecrCredential{
+		&ecrCredential{
+			Host:      "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+			Username:  "AWS",
+			Password:  "mockPassword",
+			ExpiresAt: now.Add(time.Hour),
+		},
+		// expired tokens are not written
+		&ecrCredential{
+			Host:      "109876543210.dkr.ecr.us-east-1.amazonaws.com",
+			Username:  "AWS",
+			Password:  "mockPassword",
+			ExpiresAt: now.Add(-time.Hour),
+		},
+	}
+
+	p.baseline(context.Background())
+	p.poll(context.Background(), credentials, now)
+
+	mockRegistryCredential.AssertNumberOfCalls(t, "Update", 1)
+	mockRegistryCredential.AssertNotCalled(t, "List", &client.ListOpts{Filters: map[string]interface{}{"registryId": "1r3"}})
+	assert.True(t, p.known["1r2"])
+
+	// Registries are only written to once
+	p.poll(context.Background(), credentials, now)
+
+	mockRegistryCredential.AssertNumberOfCalls(t, "Update", 1)
+}
+
+func TestRegistryPoller_pollCrossAccountName(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	added := client.Registry{Resource: client.Resource{Id: "1r2"}, Name: "prod", ServerAddress: "109876543210.dkr.ecr.us-east-1.amazonaws.com"}
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{Data: []client.Registry{}}, nil).Once()
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{Data: []client.Registry{added}}, nil)
+
+	p := &registryPoller{writer: &RancherWriter{
+		Registries:    mockRegistry,
+		Credentials:   mockRegistryCredential,
+		MatchStrategy: "name",
+		Names:         map[string]string{"prod": "012345678910.dkr.ecr.us-east-1.amazonaws.com"},
+	}}
+	credentials := []*ecrCredential{
+		&ecrCredential{Host: "012345678910.dkr.ecr.us-east-1.amazonaws.com", Username: "AWS", Password: "mockPassword"},
+	}
+	p.baseline(context.Background())
+	p.poll(context.Background(), credentials, time.Now())
+
+	// A registry in another account is not written to, nor retried
+	mockRegistry.AssertNumberOfCalls(t, "List", 2)
+	mockRegistryCredential.AssertNotCalled(t, "List", mock.Anything)
+	assert.True(t, p.known["1r2"])
+}
+
+func TestRegistryPoller_pollDenylistedHost(t *testing.T) {
+	r := &Rancher{
+		HostDenylist: []string{"012345678910.dkr.ecr.us-east-1.amazonaws.com"},
+	}
+	mockEcr := new(mocks.ECRAPI)
+	mockEcr.On("GetAuthorizationToken", &ecr.GetAuthorizationTokenInput{}).Return(
+		&ecr.GetAuthorizationTokenOutput{
+			AuthorizationData: []*ecr.AuthorizationData{
+				&ecr.AuthorizationData{
+					ProxyEndpoint:      aws.String("https://012345678910.dkr.ecr.us-east-1.amazonaws.com"),
+					AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("AWS:mockPassword"))),
+				},
+			},
+		}, nil)
+	r.updateEcr(context.Background(), mockEcr, []CredentialWriter{new(mocks.CredentialWriter)})
+
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	added := client.Registry{Resource: client.Resource{Id: "1r2"}, ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com"}
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{Data: []client.Registry{}}, nil).Once()
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{Data: []client.Registry{added}}, nil)
+
+	p := &registryPoller{writer: &RancherWriter{Registries: mockRegistry, Credentials: mockRegistryCredential}}
+	p.baseline(context.Background())
+	p.poll(context.Background(), r.cached, time.Now())
+
+	assert.Empty(t, r.cached)
+	mockRegistryCredential.AssertNotCalled(t, "List", mock.Anything)
+	mockRegistryCredential.AssertNotCalled(t, "Update", mock.Anything, mock.Anything)
+}
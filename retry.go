@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// retryAttempts is the number of times an AWS call is attempted
+	retryAttempts = 3
+	// rancherListAttempts is the number of times a Rancher read is attempted,
+	// configurable with RANCHER_LIST_RETRIES
+	rancherListAttempts = 3
+	// rancherUpdateAttempts is the number of times a Rancher write is
+	// attempted, configurable with RANCHER_UPDATE_RETRIES
+	rancherUpdateAttempts = 2
+	// retryBaseDelay is the backoff before the first retry, doubling on each attempt
+	retryBaseDelay = time.Second
+	// maxBackoff caps the backoff between attempts, configurable with MAX_BACKOFF
+	maxBackoff = 30 * time.Second
+)
+
+// retry calls fn until it succeeds, the attempts are exhausted or ctx is done.
+// Between attempts it sleeps for a random duration up to the exponential
+// backoff (full jitter), capped at maxBackoff. The last error is returned.
+func retry(ctx context.Context, attempts int, baseDelay time.Duration, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if i == attempts-1 {
+			break
+		}
+
+		// Unbounded retries would overflow the shift, so stop doubling well
+		// before that
+		backoff := maxBackoff
+		if i < 32 {
+			if b := baseDelay << uint(i); b > 0 && b < maxBackoff {
+				backoff = b
+			}
+		}
+		delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+		log.Debugf("Attempt %d/%d failed, retrying in %s: %s", i+1, attempts, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return err
+}
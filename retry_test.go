@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetry_successAfterRetry(t *testing.T) {
+	calls := 0
+	err := retry(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestRetry_giveUp(t *testing.T) {
+	calls := 0
+	err := retry(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		return errors.New("permanent")
+	})
+
+	assert.EqualError(t, err, "permanent")
+	assert.Equal(t, 3, calls)
+}
+
+func TestRetry_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := 0
+	err := retry(ctx, 3, time.Hour, func() error {
+		calls++
+		return errors.New("transient")
+	})
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, calls)
+}
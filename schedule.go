@@ -0,0 +1,21 @@
+package main
+
+import "time"
+
+// tokenLifetime is the validity of an ECR authorization token
+const tokenLifetime = 12 * time.Hour
+
+// minRefreshWait keeps a token that is already past its refresh point from
+// causing a tight update loop
+const minRefreshWait = time.Minute
+
+// nextRefresh returns how long to wait from now until percent of the lifetime
+// of the token expiring at expiresAt has elapsed
+func nextRefresh(expiresAt time.Time, percent int, now time.Time) time.Duration {
+	issuedAt := expiresAt.Add(-tokenLifetime)
+	refreshAt := issuedAt.Add(tokenLifetime * time.Duration(percent) / 100)
+	if wait := refreshAt.Sub(now); wait > minRefreshWait {
+		return wait
+	}
+	return minRefreshWait
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextRefresh(t *testing.T) {
+	issued := time.Date(2017, 3, 12, 0, 0, 0, 0, time.UTC)
+	expires := issued.Add(tokenLifetime)
+
+	assert.Equal(t, 9*time.Hour, nextRefresh(expires, 75, issued))
+	assert.Equal(t, 5*time.Hour, nextRefresh(expires, 50, issued.Add(time.Hour)))
+	assert.Equal(t, minRefreshWait, nextRefresh(expires, 50, issued.Add(7*time.Hour)))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// shutdown coordinates a graceful shutdown requested by a signal. In-flight
+// work is given the grace period to finish before its context is cancelled.
+type shutdown struct {
+	grace time.Duration
+	// ctx is the root context of update cycles, cancelled when the grace
+	// period after a shutdown signal has passed
+	ctx context.Context
+	// requested is closed when a shutdown signal is received
+	requested chan struct{}
+	// received is when the signal was received, set before requested is closed
+	received time.Time
+}
+
+// newShutdown returns a shutdown triggered by the first signal on signals
+func newShutdown(grace time.Duration, signals <-chan os.Signal) *shutdown {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &shutdown{grace: grace, ctx: ctx, requested: make(chan struct{})}
+	go func() {
+		sig := <-signals
+		s.received = time.Now()
+		log.Infof("Received %s, shutting down within %s\n", sig, grace)
+		close(s.requested)
+		time.AfterFunc(grace, cancel)
+	}()
+	return s
+}
+
+// finish drains server within what is left of the grace period and logs how
+// long the shutdown took
+func (s *shutdown) finish(server *http.Server) {
+	ctx, cancel := context.WithDeadline(context.Background(), s.received.Add(s.grace))
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warnf("Healthcheck listener did not drain in time: %s\n", err)
+	}
+	log.Infof("Shutdown completed in %s\n", time.Since(s.received))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	s := newShutdown(20*time.Millisecond, signals)
+
+	select {
+	case <-s.requested:
+		t.Fatal("shutdown requested without a signal")
+	default:
+	}
+
+	signals <- os.Interrupt
+	<-s.requested
+	assert.NoError(t, s.ctx.Err(), "in-flight work is cancelled before the grace period passed")
+
+	select {
+	case <-s.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("in-flight work not cancelled after the grace period")
+	}
+
+	s.finish(&http.Server{})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// updateState holds the outcome of past update cycles for the HTTP handlers
+type updateState struct {
+	sync.Mutex
+	// started is when the process started
+	started time.Time
+	// lastCycle is when the most recent cycle finished, successful or not
+	lastCycle time.Time
+	// failures counts the cycles that failed since the last successful one
+	failures int
+	// frozen is set while the last cycle fell into a freeze window
+	frozen bool
+	// freezeUntil is when the freeze window of the last cycle ends
+	freezeUntil time.Time
+	// nextRefresh is when the next cycle is scheduled to start
+	nextRefresh time.Time
+	// interval is the configured time between cycles
+	interval time.Duration
+	// firstSuccess is when the first cycle succeeded, zero until then
+	firstSuccess time.Time
+	// lastSuccess is when the most recent successful cycle finished
+	lastSuccess time.Time
+}
+
+// state is shared between the update loop and the HTTP handlers
+var state = &updateState{started: time.Now()}
+
+// recordCycle records the outcome res of an update cycle finished at now.
+// Cycles that fell into a freeze window or were dry runs wrote nothing, so
+// they do not count as successful for readiness.
+func (s *updateState) recordCycle(res cycleResult, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastCycle = now
+	s.frozen = res.Frozen
+	s.freezeUntil = res.FreezeUntil
+	if res.Err != nil {
+		s.failures++
+		return
+	}
+	s.failures = 0
+	if res.Frozen || res.DryRun {
+		return
+	}
+	if s.firstSuccess.IsZero() {
+		s.firstSuccess = now
+	}
+	s.lastSuccess = now
+}
+
+// schedule records when the next cycle starts and the configured interval
+// between cycles
+func (s *updateState) schedule(next time.Time, interval time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.nextRefresh = next
+	s.interval = interval
+}
+
+// ready returns nil once a cycle has succeeded, unless the credentials it
+// wrote have expired since
+func (s *updateState) ready(now time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.firstSuccess.IsZero() {
+		return fmt.Errorf("no update cycle has succeeded yet")
+	}
+	if age := now.Sub(s.lastSuccess); age > tokenLifetime {
+		return fmt.Errorf("last successful update was %s ago", age)
+	}
+	return nil
+}
+
+// logHeartbeat logs that the process is alive along with the time of the
+// next refresh and of the last successful cycle
+func (s *updateState) logHeartbeat(next time.Time) {
+	s.Lock()
+	last := s.lastSuccess
+	s.Unlock()
+	lastSuccess := "never"
+	if !last.IsZero() {
+		lastSuccess = last.Format(time.RFC3339)
+	}
+	log.Infof("Alive, next refresh at %s, last success %s\n", next.Format(time.RFC3339), lastSuccess)
+}
+
+// readyz answers 200 once credentials have been written and 503 otherwise
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if err := state.ready(time.Now()); err != nil {
+		log.Debugf("Readiness check failed: %s", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "ok")
+}
+
+// healthReport describes the liveness of the updater for /healthz
+type healthReport struct {
+	UptimeSeconds       int64  `json:"uptime_seconds"`
+	LastCycle           string `json:"last_cycle,omitempty"`
+	LastSuccess         string `json:"last_success,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	Frozen              bool   `json:"frozen"`
+}
+
+// health returns the liveness details as of now
+func (s *updateState) health(now time.Time) healthReport {
+	s.Lock()
+	defer s.Unlock()
+	report := healthReport{
+		UptimeSeconds:       int64(now.Sub(s.started) / time.Second),
+		ConsecutiveFailures: s.failures,
+		Frozen:              s.frozen,
+	}
+	if !s.lastCycle.IsZero() {
+		report.LastCycle = s.lastCycle.UTC().Format(time.RFC3339)
+	}
+	if !s.lastSuccess.IsZero() {
+		report.LastSuccess = s.lastSuccess.UTC().Format(time.RFC3339)
+	}
+	return report
+}
+
+// healthz answers 200 while the process is running. The liveness details are
+// returned as JSON when requested with ?format=json or an application/json
+// Accept header.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("format") != "json" && !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		fmt.Fprintf(w, "ok")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(state.health(time.Now())); err != nil {
+		log.Warnf("Unable to write health report: %s\n", err)
+	}
+}
+
+// scheduleReport describes the refresh cadence for /schedule
+type scheduleReport struct {
+	LastRefresh string `json:"last_refresh,omitempty"`
+	NextRefresh string `json:"next_refresh,omitempty"`
+	Interval    string `json:"interval"`
+	Frozen      bool   `json:"frozen"`
+	FreezeUntil string `json:"freeze_until,omitempty"`
+}
+
+// scheduleStatus serves the time of the last and next refresh, and whether
+// the last cycle fell into a freeze window, as JSON
+func scheduleStatus(w http.ResponseWriter, r *http.Request) {
+	state.Lock()
+	report := scheduleReport{Interval: state.interval.String(), Frozen: state.frozen}
+	if state.frozen && !state.freezeUntil.IsZero() {
+		report.FreezeUntil = state.freezeUntil.UTC().Format(time.RFC3339)
+	}
+	if !state.lastCycle.IsZero() {
+		report.LastRefresh = state.lastCycle.UTC().Format(time.RFC3339)
+	}
+	if !state.nextRefresh.IsZero() {
+		report.NextRefresh = state.nextRefresh.UTC().Format(time.RFC3339)
+	}
+	state.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Warnf("Unable to write schedule: %s\n", err)
+	}
+}
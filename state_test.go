@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateState_ready(t *testing.T) {
+	s := &updateState{}
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	assert.Error(t, s.ready(start))
+
+	s.recordCycle(cycleResult{Err: errors.New("boom")}, start)
+	assert.Error(t, s.ready(start))
+
+	s.recordCycle(cycleResult{}, start.Add(time.Minute))
+	assert.NoError(t, s.ready(start.Add(time.Hour)))
+	assert.Equal(t, start.Add(time.Minute), s.firstSuccess)
+
+	s.recordCycle(cycleResult{Err: errors.New("boom")}, start.Add(6*time.Hour))
+	assert.NoError(t, s.ready(start.Add(6*time.Hour)))
+	assert.Error(t, s.ready(start.Add(13*time.Hour)))
+
+	// Frozen cycles and dry runs write nothing and do not refresh readiness
+	s.recordCycle(cycleResult{Frozen: true}, start.Add(12*time.Hour))
+	assert.True(t, s.frozen)
+	assert.Error(t, s.ready(start.Add(13*time.Hour)))
+	s.recordCycle(cycleResult{DryRun: true}, start.Add(13*time.Hour))
+	assert.False(t, s.frozen)
+	assert.Error(t, s.ready(start.Add(13*time.Hour)))
+}
+
+func TestReadyz(t *testing.T) {
+	defer func(s *updateState) { state = s }(state)
+	state = &updateState{}
+
+	rec := httptest.NewRecorder()
+	readyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	state.recordCycle(cycleResult{}, time.Now())
+	rec = httptest.NewRecorder()
+	readyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestHealthz(t *testing.T) {
+	defer func(s *updateState) { state = s }(state)
+	state = &updateState{started: time.Now().Add(-time.Hour)}
+	state.recordCycle(cycleResult{}, time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC))
+	state.recordCycle(cycleResult{Err: errors.New("boom")}, time.Date(2017, 3, 1, 18, 0, 0, 0, time.UTC))
+
+	rec := httptest.NewRecorder()
+	healthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "ok", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	healthz(rec, httptest.NewRequest("GET", "/healthz?format=json", nil))
+	var report healthReport
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, healthReport{
+		UptimeSeconds:       3600,
+		LastCycle:           "2017-03-01T18:00:00Z",
+		LastSuccess:         "2017-03-01T12:00:00Z",
+		ConsecutiveFailures: 1,
+	}, report)
+
+	req := httptest.NewRequest("GET", "/healthz", nil)
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	healthz(rec, req)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+}
+
+func TestScheduleStatus(t *testing.T) {
+	defer func(s *updateState) { state = s }(state)
+	state = &updateState{}
+
+	rec := httptest.NewRecorder()
+	scheduleStatus(rec, httptest.NewRequest("GET", "/schedule", nil))
+	assert.JSONEq(t, `{"interval":"0s","frozen":false}`, rec.Body.String())
+
+	state.recordCycle(cycleResult{}, time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC))
+	state.schedule(time.Date(2017, 3, 1, 18, 0, 0, 0, time.UTC), 6*time.Hour)
+	rec = httptest.NewRecorder()
+	scheduleStatus(rec, httptest.NewRequest("GET", "/schedule", nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"last_refresh":"2017-03-01T12:00:00Z","next_refresh":"2017-03-01T18:00:00Z","interval":"6h0m0s","frozen":false}`, rec.Body.String())
+
+	state.recordCycle(cycleResult{Frozen: true, FreezeUntil: time.Date(2017, 3, 2, 2, 0, 0, 0, time.UTC)}, time.Date(2017, 3, 1, 23, 0, 0, 0, time.UTC))
+	rec = httptest.NewRecorder()
+	scheduleStatus(rec, httptest.NewRequest("GET", "/schedule", nil))
+	assert.JSONEq(t, `{"last_refresh":"2017-03-01T23:00:00Z","next_refresh":"2017-03-01T18:00:00Z","interval":"6h0m0s","frozen":true,"freeze_until":"2017-03-02T02:00:00Z"}`, rec.Body.String())
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// tlsVersions maps the TLS_MIN_VERSION values to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// rancherTransport returns the HTTP transport for Rancher API calls, tuned
+// with the connection pool, timeout and TLS settings of cfg
+func rancherTransport(cfg Config) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{MinVersion: tlsVersions[cfg.TLSMinVersion]},
+		Proxy:           http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.RancherDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          cfg.RancherMaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.RancherMaxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: cfg.RancherResponseTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRancherTransport(t *testing.T) {
+	defer setEnv(map[string]string{
+		"RANCHER_MAX_IDLE_CONNS":          "",
+		"RANCHER_MAX_IDLE_CONNS_PER_HOST": "50",
+		"RANCHER_RESPONSE_TIMEOUT":        "5s",
+		"TLS_MIN_VERSION":                 "",
+	})()
+	cfg, err := LoadConfig()
+	assert.NoError(t, err)
+
+	transport := rancherTransport(cfg)
+
+	assert.Equal(t, 100, transport.MaxIdleConns)
+	assert.Equal(t, 50, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 5*time.Second, transport.ResponseHeaderTimeout)
+	assert.Equal(t, uint16(tls.VersionTLS12), transport.TLSClientConfig.MinVersion)
+
+	os.Setenv("TLS_MIN_VERSION", "1.1")
+	cfg, err = LoadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS11), rancherTransport(cfg).TLSClientConfig.MinVersion)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// check is the outcome of one validation check, passed when Err is nil
+type check struct {
+	Name string
+	Err  error
+}
+
+// validateSetup runs the startup validation and self-checks against Rancher
+// and AWS once, without retrying, and returns their outcomes. configErr is the
+// error returned by LoadConfig.
+func validateSetup(cfg Config, configErr error) []check {
+	checks := []check{{"configuration", configErr}}
+	if configErr != nil {
+		return checks
+	}
+
+	cfg.FailOnClientInit = true
+	r, err := NewRancher(context.Background(), cfg)
+	checks = append(checks, check{"rancher client", err})
+	if err == nil {
+		checks = append(checks, check{"rancher access", checkRancherAccess(r.client.Registry)})
+		if allowed := splitList(cfg.AllowedAccountIDs); len(allowed) > 0 {
+			checks = append(checks, check{"rancher key scope", checkRegistryAccounts(r.client.Registry, allowed)})
+		}
+	}
+
+	registryIDs, _ := parseList(cfg.RegistryIDs)
+	if r != nil {
+		registryIDs = r.RegistryIds
+	}
+	checks = append(checks, check{"ecr access", checkECRAccess(awsClient(cfg), registryIDs)})
+	return checks
+}
+
+// printChecks writes a PASS or FAIL line per check to out and reports whether
+// all of them passed
+func printChecks(out io.Writer, checks []check) bool {
+	passed := true
+	for _, c := range checks {
+		if c.Err != nil {
+			fmt.Fprintf(out, "FAIL %s: %s\n", c.Name, c.Err)
+			passed = false
+			continue
+		}
+		fmt.Fprintf(out, "PASS %s\n", c.Name)
+	}
+	return passed
+}
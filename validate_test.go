@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintChecks(t *testing.T) {
+	out := &bytes.Buffer{}
+	assert.True(t, printChecks(out, []check{{"configuration", nil}, {"ecr access", nil}}))
+	assert.Equal(t, "PASS configuration\nPASS ecr access\n", out.String())
+
+	out.Reset()
+	assert.False(t, printChecks(out, []check{{"configuration", nil}, {"rancher access", errors.New("authentication failed")}}))
+	assert.Equal(t, "PASS configuration\nFAIL rancher access: authentication failed\n", out.String())
+}
+
+func TestValidateSetup_invalidConfig(t *testing.T) {
+	checks := validateSetup(Config{}, errors.New("REFRESH_INTERVAL must be positive"))
+
+	assert.Equal(t, []check{{"configuration", errors.New("REFRESH_INTERVAL must be positive")}}, checks)
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/client"
+)
+
+// errNoRegistry is returned by a CredentialWriter that has nowhere to store
+// the login for an ECR host
+var errNoRegistry = errors.New("no registry configured for ECR host")
+
+// hostLister is implemented by writers that can report which registry hosts
+// they hold credentials for
+type hostLister interface {
+	Hosts(ctx context.Context) (map[string]bool, error)
+}
+
+// CredentialWriter stores the login for an ECR registry host in an output target
+type CredentialWriter interface {
+	Write(ctx context.Context, host, username, password string) error
+}
+
+// RancherWriter updates the matching registry credential through the Rancher API
+type RancherWriter struct {
+	Registries  client.RegistryOperations
+	Credentials client.RegistryCredentialOperations
+	AutoCreate  bool
+	// ProjectIDs restricts updates to registries in these projects (environments)
+	ProjectIDs []string
+	// MatchStrategy selects how registries are matched to ECR hosts, see matchRegistry
+	MatchStrategy string
+	// Names maps Rancher registry names to ECR hosts when matching by name
+	Names map[string]string
+	// AllowAddressUpdate points the registry mapped to a host in Names at the
+	// host when no registry matches it by server address
+	AllowAddressUpdate bool
+	// IncludePath requires the server address to have no path when matching by
+	// host, instead of ignoring any path
+	IncludePath bool
+	// DumpResponses logs the registries and credentials returned by Rancher,
+	// with secret values redacted
+	DumpResponses bool
+	// VerifyAfterUpdate re-reads each updated credential to confirm the new
+	// username was applied
+	VerifyAfterUpdate bool
+	// StampManaged records in the description of each updated registry that it
+	// is managed by this tool and when it was last rotated
+	StampManaged bool
+	// DryRun reports the changes Write would make instead of making them
+	DryRun bool
+	// DiffOutput receives the dry run changes as JSON lines when set
+	DiffOutput io.Writer
+}
+
+// Write updates the credential of the Rancher registry configured for host,
+// creating the registry first when AutoCreate is enabled
+func (w *RancherWriter) Write(ctx context.Context, host, username, password string) error {
+	registries, err := w.listRegistries(ctx)
+	if err != nil {
+		return err
+	}
+	if w.DryRun {
+		return w.dryRun(ctx, host, username, registries)
+	}
+	logger := registryLog(host, "")
+	logger.Info("Looking for configured registry")
+	for _, registry := range registries {
+		if registryHost, err := serverHost(registry.ServerAddress); err != nil || registryHost == "" {
+			registryLog(host, registry.Id).Warnf("Skipping registry with invalid server address: %q", registry.ServerAddress)
+		}
+	}
+
+	matches, foreign := w.match(registries, host)
+	for _, registry := range foreign {
+		registryLog(host, registry.Id).Warnf("Skipping registry with server address %q in another AWS account", registry.ServerAddress)
+	}
+	// A host whose only matches are in another account has no registry to
+	// write to
+	if len(matches) == 0 && len(foreign) > 0 {
+		return errNoRegistry
+	}
+	if len(matches) > 0 {
+		failures := []string{}
+		for _, registry := range matches {
+			if err := w.updateCredential(ctx, host, registry, username, password); err != nil {
+				failures = append(failures, err.Error())
+			}
+		}
+		if len(failures) > 0 {
+			return errors.New(strings.Join(failures, "; "))
+		}
+		return nil
+	}
+	logger.Info("Did not find an existing registry")
+
+	if target := w.driftedRegistry(registries, host); target != nil {
+		return w.updateServerAddress(ctx, host, *target, username, password)
+	}
+
+	// If we made it this far, it means we were not able to find an existing registry to update in Rancher
+	if !w.AutoCreate {
+		return errNoRegistry
+	}
+
+	logger.Info("Automatically creating registry")
+	// Creates are not retried, as a request that failed after reaching Rancher
+	// would leave a duplicate registry behind
+	registry, err := w.Registries.Create(&client.Registry{
+		ServerAddress: host,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating registry for host: %s, %s", host, err)
+	}
+	_, err = w.Credentials.Create(&client.RegistryCredential{
+		RegistryId:  registry.Id,
+		PublicValue: username,
+		SecretValue: password,
+		Email:       "not-really@required.anymore",
+	})
+	if err != nil {
+		return fmt.Errorf("error creating registry credential for host: %s, %s", host, err)
+	}
+	registryLog(host, registry.Id).Info("Successfully created registry and updated credential")
+	return nil
+}
+
+// Matches returns the ids of the Rancher registries Write would update for
+// host, without writing anything
+func (w *RancherWriter) Matches(ctx context.Context, host string) ([]string, error) {
+	registries, err := w.listRegistries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	matches, _ := w.match(registries, host)
+	for _, registry := range matches {
+		ids = append(ids, registry.Id)
+	}
+	return ids, nil
+}
+
+// driftedRegistry returns the registry mapped to host by name, if server
+// address updates are allowed and exactly one registry is mapped to it
+func (w *RancherWriter) driftedRegistry(registries []client.Registry, host string) *client.Registry {
+	if !w.AllowAddressUpdate {
+		return nil
+	}
+	if named := matchRegistriesByName(registries, w.Names, host); len(named) == 1 {
+		return &named[0]
+	}
+	return nil
+}
+
+// updateServerAddress points registry at host and then updates its credential
+func (w *RancherWriter) updateServerAddress(ctx context.Context, host string, registry client.Registry, username, password string) error {
+	registryLog(host, registry.Id).Warnf("Updating server address of registry %s from %q to %q", registry.Name, registry.ServerAddress, host)
+	err := retry(ctx, rancherUpdateAttempts, retryBaseDelay, func() error {
+		_, err := w.Registries.Update(&registry, map[string]interface{}{"serverAddress": host})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update server address of registry %s, %s", registry.Id, err)
+	}
+	registry.ServerAddress = host
+	return w.updateCredential(ctx, host, registry, username, password)
+}
+
+// updateCredential replaces the login stored for an existing Rancher registry
+func (w *RancherWriter) updateCredential(ctx context.Context, host string, registry client.Registry, username, password string) error {
+	credentials, err := w.listCredentials(ctx, registry.Id)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve registry credentials for id: %s, %s", registry.Id, err)
+	}
+	if len(credentials) != 1 {
+		return fmt.Errorf("expected 1 credential for registry %s, found %d", registry.Id, len(credentials))
+	}
+	credential := credentials[0]
+	err = retry(ctx, rancherUpdateAttempts, retryBaseDelay, func() error {
+		_, err := w.Credentials.Update(&credential, &client.RegistryCredential{
+			PublicValue: username,
+			SecretValue: password,
+			Email:       "not-really@required.anymore",
+		})
+		if isConflict(err) {
+			// Another writer changed the credential; retry against its current version
+			registryLog(host, registry.Id).Debugf("Conflict updating credential %s, re-fetching it: %s", credential.Id, err)
+			if fresh, ferr := w.Credentials.ById(credential.Id); ferr == nil && fresh != nil {
+				credential = *fresh
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update registry credential %s, %s", credential.Id, err)
+	}
+	registryLog(host, registry.Id).Infof("Successfully updated credential %s; registry address: %s", credential.Id, registry.ServerAddress)
+	if w.VerifyAfterUpdate {
+		w.verifyCredential(host, registry.Id, credential.Id, username)
+	}
+	if w.StampManaged {
+		w.stampManaged(host, registry, time.Now())
+	}
+	return nil
+}
+
+// verifyCredential warns if the credential does not hold username after an
+// update. The password cannot be read back, so only the username is compared.
+func (w *RancherWriter) verifyCredential(host, registryID, credentialID, username string) {
+	logger := registryLog(host, registryID)
+	credential, err := w.Credentials.ById(credentialID)
+	switch {
+	case err != nil:
+		logger.Warnf("Unable to verify credential %s: %s", credentialID, err)
+	case credential == nil:
+		logger.Warnf("Unable to verify credential %s: not found", credentialID)
+	case credential.PublicValue != username:
+		logger.Warnf("Credential %s was not applied: username is %q, expected %q", credentialID, credential.PublicValue, username)
+	default:
+		logger.Debugf("Verified credential %s", credentialID)
+	}
+}
+
+// managedMarker starts the description line set by stampManaged
+const managedMarker = "managed-by: rancher-ecr-credentials"
+
+// stampManaged marks registry as managed by this tool with a line in its
+// description, replacing the line left by a previous rotation and keeping the
+// rest. Rancher registries have no labels, and failures only produce a
+// warning since the credential itself has already been updated.
+func (w *RancherWriter) stampManaged(host string, registry client.Registry, rotated time.Time) {
+	lines := []string{}
+	for _, line := range strings.Split(registry.Description, "\n") {
+		if line != "" && !strings.HasPrefix(line, managedMarker) {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, fmt.Sprintf("%s, last-rotated: %s", managedMarker, rotated.UTC().Format(time.RFC3339)))
+	description := strings.Join(lines, "\n")
+	if _, err := w.Registries.Update(&registry, map[string]interface{}{"description": description}); err != nil {
+		registryLog(host, registry.Id).Warnf("Unable to stamp registry as managed: %s", err)
+	}
+}
+
+// isConflict reports whether err is a Rancher API conflict, returned when the
+// resource was modified since it was read
+func isConflict(err error) bool {
+	apiErr, ok := err.(*client.ApiError)
+	return ok && apiErr.StatusCode == http.StatusConflict
+}
+
+// listCredentials returns the credentials of a registry, following the
+// pagination markers until every page has been read
+func (w *RancherWriter) listCredentials(ctx context.Context, registryID string) ([]client.RegistryCredential, error) {
+	credentials := []client.RegistryCredential{}
+	marker := ""
+	for {
+		filters := map[string]interface{}{
+			"registryId": registryID,
+		}
+		if marker != "" {
+			filters["marker"] = marker
+		}
+		var page *client.RegistryCredentialCollection
+		err := retry(ctx, rancherListAttempts, retryBaseDelay, func() error {
+			var err error
+			page, err = w.Credentials.List(&client.ListOpts{Filters: filters})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, page.Data...)
+		if w.DumpResponses {
+			dumpCredentials(registryID, page.Data)
+		}
+
+		if page.Pagination == nil || page.Pagination.Next == "" {
+			return credentials, nil
+		}
+		next, err := url.Parse(page.Pagination.Next)
+		if err != nil {
+			return nil, fmt.Errorf("invalid next page link: %s", err)
+		}
+		if marker = next.Query().Get("marker"); marker == "" {
+			return nil, fmt.Errorf("next page link has no marker: %s", page.Pagination.Next)
+		}
+	}
+}
+
+// registryLog returns a logger carrying the ECR host and, when known, the id
+// of the Rancher registry being worked on
+func registryLog(host, registryID string) *log.Entry {
+	fields := log.Fields{"host": host}
+	if registryID != "" {
+		fields["registry_id"] = registryID
+	}
+	return log.WithFields(fields)
+}
+
+// dumpRegistries logs the registries returned by Rancher
+func dumpRegistries(registries []client.Registry) {
+	log.Infof("Rancher returned %d registries\n", len(registries))
+	for _, registry := range registries {
+		log.WithFields(log.Fields{
+			"registry_id":    registry.Id,
+			"account_id":     registry.AccountId,
+			"name":           registry.Name,
+			"server_address": registry.ServerAddress,
+			"state":          registry.State,
+		}).Info("Rancher registry")
+	}
+}
+
+// dumpCredentials logs the credentials returned by Rancher for a registry.
+// Secret values are never logged.
+func dumpCredentials(registryID string, credentials []client.RegistryCredential) {
+	log.WithField("registry_id", registryID).Infof("Rancher returned %d credentials\n", len(credentials))
+	for _, credential := range credentials {
+		log.WithFields(log.Fields{
+			"registry_id":   registryID,
+			"credential_id": credential.Id,
+			"public_value":  credential.PublicValue,
+			"secret_value":  "[redacted]",
+			"state":         credential.State,
+		}).Info("Rancher registry credential")
+	}
+}
+
+// Hosts returns the set of registry hosts configured in Rancher
+func (w *RancherWriter) Hosts(ctx context.Context) (map[string]bool, error) {
+	registries, err := w.listRegistries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hosts := map[string]bool{}
+	for _, registry := range registries {
+		if w.MatchStrategy != "host" {
+			if mapped, ok := w.Names[registry.Name]; ok {
+				hosts[strings.ToLower(mapped)] = true
+			}
+		}
+		if w.MatchStrategy == "name" {
+			continue
+		}
+		if registryHost, err := serverHost(registry.ServerAddress); err == nil && registryHost != "" {
+			hosts[registryHost] = true
+		}
+	}
+	return hosts, nil
+}
+
+func (w *RancherWriter) listRegistries(ctx context.Context) ([]client.Registry, error) {
+	var registries *client.RegistryCollection
+	err := retry(ctx, rancherListAttempts, retryBaseDelay, func() error {
+		var err error
+		registries, err = w.Registries.List(&client.ListOpts{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve registries: %s", err)
+	}
+	if w.DumpResponses {
+		dumpRegistries(registries.Data)
+	}
+	if len(w.ProjectIDs) == 0 {
+		return registries.Data, nil
+	}
+
+	projects := map[string]bool{}
+	for _, id := range w.ProjectIDs {
+		projects[id] = true
+	}
+	inProjects := []client.Registry{}
+	for _, registry := range registries.Data {
+		if projects[registry.AccountId] {
+			inProjects = append(inProjects, registry)
+		}
+	}
+	return inProjects, nil
+}
+
+// match returns the registries to update for host using the configured strategy
+// match returns the registries to update with the token of host. Matched
+// registries whose server address is an ECR host in another AWS account are
+// returned separately as foreign and must not be written to.
+func (w *RancherWriter) match(registries []client.Registry, host string) (matches, foreign []client.Registry) {
+	matches = []client.Registry{}
+	for _, registry := range matchRegistry(registries, host, w.MatchStrategy, w.Names, w.IncludePath) {
+		if sameAccount(host, registry.ServerAddress) {
+			matches = append(matches, registry)
+		} else {
+			foreign = append(foreign, registry)
+		}
+	}
+	return matches, foreign
+}
+
+// matchRegistry returns the registries to update with the token of host
+// using strategy:
+//   - "host" matches registries whose server address refers to host, see
+//     matchRegistries
+//   - "name" matches registries whose name is mapped to host in names
+//   - "host_then_name" matches by host and falls back to names when no
+//     registry matches by host
+func matchRegistry(registries []client.Registry, host, strategy string, names map[string]string, includePath bool) []client.Registry {
+	switch strategy {
+	case "name":
+		return matchRegistriesByName(registries, names, host)
+	case "host_then_name":
+		if matches := matchRegistries(registries, host, includePath); len(matches) > 0 {
+			return matches
+		}
+		return matchRegistriesByName(registries, names, host)
+	}
+	return matchRegistries(registries, host, includePath)
+}
+
+// matchRegistriesByName returns the registries whose name is mapped to host
+func matchRegistriesByName(registries []client.Registry, names map[string]string, host string) []client.Registry {
+	matches := []client.Registry{}
+	for _, registry := range registries {
+		if mapped, ok := names[registry.Name]; ok && strings.EqualFold(mapped, host) {
+			matches = append(matches, registry)
+		}
+	}
+	return matches
+}
+
+// matchRegistries returns the registries whose server address refers to host.
+// Any path in the server address is ignored unless includePath is set, in
+// which case only addresses without a path match.
+func matchRegistries(registries []client.Registry, host string, includePath bool) []client.Registry {
+	matches := []client.Registry{}
+	host = strings.ToLower(host)
+	for _, registry := range registries {
+		registryHost, err := serverHost(registry.ServerAddress)
+		if err != nil || registryHost == "" {
+			continue
+		}
+		if includePath && serverPath(registry.ServerAddress) != "" {
+			continue
+		}
+		if registryHost == host {
+			matches = append(matches, registry)
+		}
+	}
+	return matches
+}
+
+// sameAccount reports whether the registry server address does not belong to
+// a different AWS account than the ECR host. Addresses that are not ECR hosts
+// carry no account and are not rejected.
+func sameAccount(host, address string) bool {
+	registryHost, err := serverHost(address)
+	if err != nil {
+		return true
+	}
+	account := ecrAccountID(registryHost)
+	return account == "" || account == ecrAccountID(host)
+}
+
+// ecrAccountID returns the AWS account ID of an ECR registry host, such as
+// 012345678910.dkr.ecr.us-east-1.amazonaws.com, or "" for other hosts
+func ecrAccountID(host string) string {
+	labels := strings.SplitN(strings.ToLower(host), ".", 4)
+	if len(labels) < 4 || labels[1] != "dkr" || !strings.HasPrefix(labels[2], "ecr") {
+		return ""
+	}
+	return labels[0]
+}
+
+// ecrRegion returns the AWS region of an ECR registry host, such as
+// 012345678910.dkr.ecr.us-east-1.amazonaws.com, or "" for other hosts
+func ecrRegion(host string) string {
+	labels := strings.SplitN(strings.ToLower(host), ".", 5)
+	if len(labels) < 5 || labels[1] != "dkr" || !strings.HasPrefix(labels[2], "ecr") {
+		return ""
+	}
+	return labels[3]
+}
+
+// serverHost returns the lower cased host of a Rancher registry server
+// address, which may be given with or without a URL scheme and path
+func serverHost(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	if !strings.Contains(address, "://") {
+		address = "//" + address
+	}
+	serverAddress, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(serverAddress.Host), nil
+}
+
+// serverPath returns the path of a Rancher registry server address without
+// leading or trailing slashes
+func serverPath(address string) string {
+	address = strings.TrimSpace(address)
+	if !strings.Contains(address, "://") {
+		address = "//" + address
+	}
+	serverAddress, err := url.Parse(address)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(serverAddress.Path, "/")
+}
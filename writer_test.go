@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher/client"
+	"github.com/rancher/rancher-ecr-credentials/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRancherWriter_noMatch(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{
+					Resource: client.Resource{
+						Id: "1r1",
+					},
+					ServerAddress: "registry.example.com",
+				},
+			},
+		},
+		nil,
+	)
+
+	w := &RancherWriter{
+		Registries:  mockRegistry,
+		Credentials: mockRegistryCredential,
+	}
+	err := w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword")
+
+	assert.Equal(t, errNoRegistry, err)
+	mockRegistry.AssertExpectations(t)
+	mockRegistry.AssertNotCalled(t, "Create", mock.Anything)
+	mockRegistryCredential.AssertNotCalled(t, "List", mock.Anything)
+}
+
+func TestMatchRegistries(t *testing.T) {
+	host := "012345678910.dkr.ecr.us-east-1.amazonaws.com"
+	for _, test := range []struct {
+		address string
+		match   bool
+	}{
+		{"012345678910.dkr.ecr.us-east-1.amazonaws.com", true},
+		{"https://012345678910.dkr.ecr.us-east-1.amazonaws.com", true},
+		{"http://012345678910.dkr.ecr.us-east-1.amazonaws.com/", true},
+		{"012345678910.dkr.ecr.us-east-1.amazonaws.com/", true},
+		{"012345678910.dkr.ecr.us-east-1.amazonaws.com/v2", true},
+		// pull-through cache repositories live under a prefix on the same host
+		{"012345678910.dkr.ecr.us-east-1.amazonaws.com/ecr-public", true},
+		{"https://012345678910.dkr.ecr.us-east-1.amazonaws.com/quay/", true},
+		{"012345678910.DKR.ECR.US-EAST-1.AMAZONAWS.COM", true},
+		{" 012345678910.dkr.ecr.us-east-1.amazonaws.com ", true},
+		{"012345678910.dkr.ecr.us-east-1.amazonaws.com:443", false},
+		{"012345678910.dkr.ecr.us-west-2.amazonaws.com", false},
+		{"", false},
+		{"https://", false},
+		{"/", false},
+	} {
+		registries := []client.Registry{
+			client.Registry{
+				Resource:      client.Resource{Id: "1r1"},
+				ServerAddress: test.address,
+			},
+		}
+
+		matches := matchRegistries(registries, host, false)
+
+		if test.match {
+			assert.Equal(t, registries, matches, test.address)
+		} else {
+			assert.Empty(t, matches, test.address)
+		}
+	}
+}
+
+func TestMatchRegistries_multiple(t *testing.T) {
+	registries := []client.Registry{
+		client.Registry{Resource: client.Resource{Id: "1r1"}, ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com"},
+		client.Registry{Resource: client.Resource{Id: "1r2"}, ServerAddress: "registry.example.com"},
+		client.Registry{Resource: client.Resource{Id: "1r3"}, ServerAddress: "https://012345678910.dkr.ecr.us-east-1.amazonaws.com"},
+	}
+
+	matches := matchRegistries(registries, "012345678910.dkr.ecr.us-east-1.amazonaws.com", false)
+
+	assert.Equal(t, []client.Registry{registries[0], registries[2]}, matches)
+}
+
+func TestMatchRegistries_includePath(t *testing.T) {
+	registries := []client.Registry{
+		client.Registry{Resource: client.Resource{Id: "1r1"}, ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com"},
+		client.Registry{Resource: client.Resource{Id: "1r2"}, ServerAddress: "https://012345678910.dkr.ecr.us-east-1.amazonaws.com/"},
+		client.Registry{Resource: client.Resource{Id: "1r3"}, ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com/ecr-public"},
+		client.Registry{Resource: client.Resource{Id: "1r4"}, ServerAddress: "https://012345678910.dkr.ecr.us-east-1.amazonaws.com/proxy/v2"},
+	}
+
+	assert.Equal(t, registries, matchRegistries(registries, "012345678910.dkr.ecr.us-east-1.amazonaws.com", false))
+	assert.Equal(t, registries[:2], matchRegistries(registries, "012345678910.dkr.ecr.us-east-1.amazonaws.com", true))
+}
+
+func TestRancherWriter_projectIDs(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{
+					Resource:      client.Resource{Id: "1r1"},
+					AccountId:     "1a5",
+					ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+				},
+				client.Registry{
+					Resource:      client.Resource{Id: "1r2"},
+					AccountId:     "1a7",
+					ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+				},
+			},
+		},
+		nil,
+	)
+	credential := client.RegistryCredential{
+		Resource:   client.Resource{Id: "1rc2"},
+		RegistryId: "1r2",
+	}
+	mockRegistryCredential.On("List", &client.ListOpts{
+		Filters: map[string]interface{}{
+			"registryId": "1r2",
+		},
+	}).Return(&client.RegistryCredentialCollection{
+		Data: []client.RegistryCredential{credential},
+	}, nil)
+	mockRegistryCredential.On("Update", &credential, mock.Anything).Return(&client.RegistryCredential{}, nil)
+
+	w := &RancherWriter{
+		Registries:  mockRegistry,
+		Credentials: mockRegistryCredential,
+		ProjectIDs:  []string{"1a7"},
+	}
+	err := w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword")
+
+	assert.NoError(t, err)
+	mockRegistryCredential.AssertExpectations(t)
+	mockRegistryCredential.AssertNumberOfCalls(t, "Update", 1)
+}
+
+func TestMatchRegistriesByName(t *testing.T) {
+	registries := []client.Registry{
+		client.Registry{Resource: client.Resource{Id: "1r1"}, Name: "ecr-proxy", ServerAddress: "registry-proxy.example.com"},
+		client.Registry{Resource: client.Resource{Id: "1r2"}, Name: "other", ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com"},
+	}
+	names := map[string]string{"ecr-proxy": "012345678910.dkr.ecr.us-east-1.amazonaws.com"}
+
+	matches := matchRegistriesByName(registries, names, "012345678910.dkr.ecr.us-east-1.amazonaws.com")
+
+	assert.Equal(t, []client.Registry{registries[0]}, matches)
+	assert.Empty(t, matchRegistriesByName(registries, names, "012345678910.dkr.ecr.us-west-2.amazonaws.com"))
+}
+
+func TestMatchRegistry(t *testing.T) {
+	registries := []client.Registry{
+		client.Registry{Resource: client.Resource{Id: "1r1"}, Name: "ecr-proxy", ServerAddress: "registry-proxy.example.com"},
+		client.Registry{Resource: client.Resource{Id: "1r2"}, Name: "other", ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com"},
+	}
+	names := map[string]string{
+		"ecr-proxy": "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+		"other":     "012345678910.dkr.ecr.us-west-2.amazonaws.com",
+	}
+	east := "012345678910.dkr.ecr.us-east-1.amazonaws.com"
+	west := "012345678910.dkr.ecr.us-west-2.amazonaws.com"
+
+	for _, test := range []struct {
+		strategy string
+		host     string
+		want     []client.Registry
+	}{
+		{"host", east, []client.Registry{registries[1]}},
+		{"host", west, []client.Registry{}},
+		{"name", east, []client.Registry{registries[0]}},
+		{"name", west, []client.Registry{registries[1]}},
+		{"host_then_name", east, []client.Registry{registries[1]}},
+		{"host_then_name", west, []client.Registry{registries[1]}},
+		{"host_then_name", "109876543210.dkr.ecr.us-east-1.amazonaws.com", []client.Registry{}},
+	} {
+		matches := matchRegistry(registries, test.host, test.strategy, names, false)
+
+		assert.Equal(t, test.want, matches, test.strategy+" "+test.host)
+	}
+}
+
+func TestRancherWriter_paginatedCredentials(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{
+					Resource:      client.Resource{Id: "1r1"},
+					ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+				},
+			},
+		},
+		nil,
+	)
+	mockRegistryCredential.On("List", &client.ListOpts{
+		Filters: map[string]interface{}{
+			"registryId": "1r1",
+		},
+	}).Return(&client.RegistryCredentialCollection{
+		Collection: client.Collection{
+			Pagination: &client.Pagination{
+				Next: "http://rancher/v1/registrycredentials?registryId=1r1&marker=m%3A1rc1",
+			},
+		},
+		Data: []client.RegistryCredential{
+			client.RegistryCredential{Resource: client.Resource{Id: "1rc1"}, RegistryId: "1r1"},
+		},
+	}, nil)
+	mockRegistryCredential.On("List", &client.ListOpts{
+		Filters: map[string]interface{}{
+			"registryId": "1r1",
+			"marker":     "m:1rc1",
+		},
+	}).Return(&client.RegistryCredentialCollection{
+		Data: []client.RegistryCredential{
+			client.RegistryCredential{Resource: client.Resource{Id: "1rc2"}, RegistryId: "1r1"},
+		},
+	}, nil)
+
+	w := &RancherWriter{
+		Registries:  mockRegistry,
+		Credentials: mockRegistryCredential,
+	}
+	err := w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword")
+
+	assert.EqualError(t, err, "expected 1 credential for registry 1r1, found 2")
+	mockRegistryCredential.AssertExpectations(t)
+	mockRegistryCredential.AssertNotCalled(t, "Update", mock.Anything, mock.Anything)
+}
+
+func TestRancherWriter_dryRun(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{
+					Resource:      client.Resource{Id: "1r1"},
+					ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+				},
+				client.Registry{
+					Resource:      client.Resource{Id: "1r2"},
+					ServerAddress: "",
+				},
+			},
+		},
+		nil,
+	)
+	mockRegistryCredential.On("List", &client.ListOpts{Filters: map[string]interface{}{"registryId": "1r1"}}).Return(
+		&client.RegistryCredentialCollection{
+			Data: []client.RegistryCredential{
+				client.RegistryCredential{Resource: client.Resource{Id: "1c1"}, PublicValue: "oldUser"},
+			},
+		},
+		nil,
+	)
+
+	out := &bytes.Buffer{}
+	w := &RancherWriter{
+		Registries:  mockRegistry,
+		Credentials: mockRegistryCredential,
+		AutoCreate:  true,
+		DryRun:      true,
+		DiffOutput:  out,
+	}
+	assert.NoError(t, w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword"))
+	assert.NoError(t, w.Write(context.Background(), "109876543210.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword"))
+
+	mockRegistry.AssertNotCalled(t, "Create", mock.Anything)
+	mockRegistryCredential.AssertNotCalled(t, "Update", mock.Anything, mock.Anything)
+	mockRegistryCredential.AssertNotCalled(t, "Create", mock.Anything)
+	assert.NotContains(t, out.String(), "mockPassword")
+
+	diffs := []credentialDiff{}
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		var diff credentialDiff
+		assert.NoError(t, dec.Decode(&diff))
+		diffs = append(diffs, diff)
+	}
+	assert.Equal(t, []credentialDiff{
+		{Host: "012345678910.dkr.ecr.us-east-1.amazonaws.com", RegistryID: "1r2", Action: "skip", Reason: "invalid server address"},
+		{Host: "012345678910.dkr.ecr.us-east-1.amazonaws.com", RegistryID: "1r1", ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+			Action: "update", CurrentUsername: "oldUser", DesiredUsername: "mockUser", DesiredPassword: maskedPassword},
+		{Host: "109876543210.dkr.ecr.us-east-1.amazonaws.com", RegistryID: "1r2", Action: "skip", Reason: "invalid server address"},
+		{Host: "109876543210.dkr.ecr.us-east-1.amazonaws.com", ServerAddress: "109876543210.dkr.ecr.us-east-1.amazonaws.com",
+			Action: "create", DesiredUsername: "mockUser", DesiredPassword: maskedPassword},
+	}, diffs)
+}
+
+func TestRancherWriter_updateConflict(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{
+					Resource:      client.Resource{Id: "1r1"},
+					ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+				},
+			},
+		},
+		nil,
+	)
+	stale := client.RegistryCredential{Resource: client.Resource{Id: "1rc1"}, RegistryId: "1r1", PublicValue: "stale"}
+	fresh := client.RegistryCredential{Resource: client.Resource{Id: "1rc1"}, RegistryId: "1r1", PublicValue: "fresh"}
+	mockRegistryCredential.On("List", &client.ListOpts{Filters: map[string]interface{}{"registryId": "1r1"}}).Return(
+		&client.RegistryCredentialCollection{Data: []client.RegistryCredential{stale}}, nil)
+	mockRegistryCredential.On("Update", &stale, mock.Anything).Return(nil, &client.ApiError{StatusCode: 409, Status: "409 Conflict"})
+	mockRegistryCredential.On("ById", "1rc1").Return(&fresh, nil)
+	mockRegistryCredential.On("Update", &fresh, mock.Anything).Return(&fresh, nil)
+
+	w := &RancherWriter{
+		Registries:  mockRegistry,
+		Credentials: mockRegistryCredential,
+	}
+	err := w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword")
+
+	// Only succeeds if the second update is made with the re-fetched credential
+	assert.NoError(t, err)
+	mockRegistryCredential.AssertCalled(t, "ById", "1rc1")
+	mockRegistryCredential.AssertNumberOfCalls(t, "Update", 2)
+}
+
+func TestRancherWriter_createNotRetried(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistry.On("List", &client.ListOpts{}).Return(&client.RegistryCollection{}, nil)
+	mockRegistry.On("Create", mock.Anything).Return(nil, errors.New("timeout"))
+
+	w := &RancherWriter{
+		Registries:  mockRegistry,
+		Credentials: new(mocks.RegistryCredentialOperations),
+		AutoCreate:  true,
+	}
+	err := w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword")
+
+	assert.Error(t, err)
+	mockRegistry.AssertNumberOfCalls(t, "Create", 1)
+}
+
+func TestRancherWriter_stampManaged(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	registry := client.Registry{Resource: client.Resource{Id: "1r1"}}
+	mockRegistry.On("Update", mock.AnythingOfType("*client.Registry"), map[string]interface{}{
+		"description": "managed-by: rancher-ecr-credentials, last-rotated: 2017-03-01T12:00:00Z",
+	}).Return(nil, errors.New("description is not updatable"))
+
+	w := &RancherWriter{Registries: mockRegistry}
+	w.stampManaged("012345678910.dkr.ecr.us-east-1.amazonaws.com", registry, time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC))
+
+	mockRegistry.AssertExpectations(t)
+}
+
+func TestRancherWriter_stampManagedKeepsDescription(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	registry := client.Registry{
+		Resource:    client.Resource{Id: "1r1"},
+		Description: "Production images\nmanaged-by: rancher-ecr-credentials, last-rotated: 2017-03-01T00:00:00Z",
+	}
+	mockRegistry.On("Update", mock.AnythingOfType("*client.Registry"), map[string]interface{}{
+		"description": "Production images\nmanaged-by: rancher-ecr-credentials, last-rotated: 2017-03-01T12:00:00Z",
+	}).Return(&registry, nil)
+
+	w := &RancherWriter{Registries: mockRegistry}
+	w.stampManaged("012345678910.dkr.ecr.us-east-1.amazonaws.com", registry, time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC))
+
+	mockRegistry.AssertExpectations(t)
+}
+
+func TestSameAccount(t *testing.T) {
+	host := "012345678910.dkr.ecr.us-east-1.amazonaws.com"
+	for _, test := range []struct {
+		address string
+		same    bool
+	}{
+		{"012345678910.dkr.ecr.us-east-1.amazonaws.com", true},
+		{"https://012345678910.dkr.ecr-fips.us-east-1.amazonaws.com/ecr-public", true},
+		{"109876543210.dkr.ecr.us-east-1.amazonaws.com", false},
+		{"https://109876543210.DKR.ECR.us-west-2.amazonaws.com", false},
+		{"registry.example.com", true},
+		{"", true},
+	} {
+		assert.Equal(t, test.same, sameAccount(host, test.address), test.address)
+	}
+}
+
+func TestRancherWriter_crossAccountName(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{
+					Resource:      client.Resource{Id: "1r1"},
+					Name:          "prod",
+					ServerAddress: "109876543210.dkr.ecr.us-east-1.amazonaws.com",
+				},
+			},
+		},
+		nil,
+	)
+
+	w := &RancherWriter{
+		Registries:    mockRegistry,
+		Credentials:   mockRegistryCredential,
+		MatchStrategy: "name",
+		Names:         map[string]string{"prod": "012345678910.dkr.ecr.us-east-1.amazonaws.com"},
+	}
+	err := w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword")
+
+	assert.Equal(t, errNoRegistry, err)
+	mockRegistryCredential.AssertNotCalled(t, "List", mock.Anything)
+	mockRegistryCredential.AssertNotCalled(t, "Update", mock.Anything, mock.Anything)
+}
+
+func TestRancherWriter_crossAccountNameDryRun(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{
+					Resource:      client.Resource{Id: "1r1"},
+					Name:          "prod",
+					ServerAddress: "109876543210.dkr.ecr.us-east-1.amazonaws.com",
+				},
+			},
+		},
+		nil,
+	)
+
+	out := &bytes.Buffer{}
+	w := &RancherWriter{
+		Registries:    mockRegistry,
+		Credentials:   mockRegistryCredential,
+		MatchStrategy: "name",
+		Names:         map[string]string{"prod": "012345678910.dkr.ecr.us-east-1.amazonaws.com"},
+		DryRun:        true,
+		DiffOutput:    out,
+	}
+	err := w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword")
+
+	assert.NoError(t, err)
+	mockRegistryCredential.AssertNotCalled(t, "List", mock.Anything)
+	var diff credentialDiff
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &diff))
+	assert.Equal(t, credentialDiff{Host: "012345678910.dkr.ecr.us-east-1.amazonaws.com", RegistryID: "1r1",
+		ServerAddress: "109876543210.dkr.ecr.us-east-1.amazonaws.com", Action: "skip", Reason: "registry in another AWS account"}, diff)
+}
+
+func TestRancherWriter_verifyAfterUpdate(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{
+			Data: []client.Registry{
+				client.Registry{
+					Resource:      client.Resource{Id: "1r1"},
+					ServerAddress: "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+				},
+			},
+		},
+		nil,
+	)
+	credential := client.RegistryCredential{Resource: client.Resource{Id: "1rc1"}, RegistryId: "1r1"}
+	mockRegistryCredential.On("List", &client.ListOpts{Filters: map[string]interface{}{"registryId": "1r1"}}).Return(
+		&client.RegistryCredentialCollection{Data: []client.RegistryCredential{credential}}, nil)
+	mockRegistryCredential.On("Update", mock.Anything, mock.Anything).Return(&credential, nil)
+	mockRegistryCredential.On("ById", "1rc1").Return(&client.RegistryCredential{
+		Resource:    client.Resource{Id: "1rc1"},
+		PublicValue: "oldUser",
+	}, nil)
+
+	w := &RancherWriter{
+		Registries:        mockRegistry,
+		Credentials:       mockRegistryCredential,
+		VerifyAfterUpdate: true,
+	}
+	err := w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword")
+
+	// A credential that was not applied is only warned about
+	assert.NoError(t, err)
+	mockRegistryCredential.AssertCalled(t, "ById", "1rc1")
+}
+
+func TestRancherWriter_allowAddressUpdate(t *testing.T) {
+	mockRegistry := new(mocks.RegistryOperations)
+	mockRegistryCredential := new(mocks.RegistryCredentialOperations)
+	registry := client.Registry{
+		Resource:      client.Resource{Id: "1r1"},
+		Name:          "prod",
+		ServerAddress: "109876543210.dkr.ecr.us-east-1.amazonaws.com",
+	}
+	mockRegistry.On("List", &client.ListOpts{}).Return(
+		&client.RegistryCollection{Data: []client.Registry{registry}},
+		nil,
+	)
+	mockRegistry.On("Update", mock.AnythingOfType("*client.Registry"), map[string]interface{}{
+		"serverAddress": "012345678910.dkr.ecr.us-east-1.amazonaws.com",
+	}).Return(&registry, nil)
+	credential := client.RegistryCredential{Resource: client.Resource{Id: "1rc1"}, RegistryId: "1r1"}
+	mockRegistryCredential.On("List", &client.ListOpts{Filters: map[string]interface{}{"registryId": "1r1"}}).Return(
+		&client.RegistryCredentialCollection{Data: []client.RegistryCredential{credential}}, nil)
+	mockRegistryCredential.On("Update", &credential, mock.Anything).Return(&credential, nil)
+
+	w := &RancherWriter{
+		Registries:         mockRegistry,
+		Credentials:        mockRegistryCredential,
+		Names:              map[string]string{"prod": "012345678910.dkr.ecr.us-east-1.amazonaws.com"},
+		AllowAddressUpdate: true,
+	}
+	err := w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword")
+
+	assert.NoError(t, err)
+	mockRegistry.AssertExpectations(t)
+	mockRegistryCredential.AssertExpectations(t)
+
+	w.AllowAddressUpdate = false
+	err = w.Write(context.Background(), "012345678910.dkr.ecr.us-east-1.amazonaws.com", "mockUser", "mockPassword")
+	assert.Equal(t, errNoRegistry, err)
+}